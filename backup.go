@@ -0,0 +1,82 @@
+package memdb
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// restoreBatch is the number of restored items written to the log at once
+const restoreBatch = 10000
+
+var ErrNotEmpty = errors.New("database is not empty")
+
+// Backup streams a consistent copy of the committed items and index definitions to w
+// in the snapshot format without encryption. Writers are blocked only while the keys are cloned.
+func (db *Database) Backup(w io.Writer) error {
+	_, defs, items, err := db.collect(nil)
+	if err != nil {
+		return err
+	}
+
+	return encodeSnapshot(w, 0, defs, items)
+}
+
+// Restore loads a backup into the empty database and writes it to the log if the
+// database is persistent. Indexes with comparators that are not registered are skipped.
+func (db *Database) Restore(r io.Reader) error {
+	db.writeTx.Lock()
+	defer db.writeTx.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(db.items.keys()) > 0 || len(db.indexes.Stats()) > 0 {
+		return ErrNotEmpty
+	}
+
+	// Readers don't take the write lock, so the items are decoded aside and
+	// replace the empty ones only when the whole backup was read
+	items := newItems()
+	_, defs, err := decodeSnapshot(r, &items, db.compression)
+	if err != nil {
+		return err
+	}
+	db.items.replace(&items)
+
+	db.restoreIndexes(defs)
+
+	return db.appendItems(db.items.committed())
+}
+
+// appendItems writes set records of items to the log in batches
+func (db *Database) appendItems(items []*item) error {
+	if db.storage == nil {
+		return nil
+	}
+
+	var wait func() error
+	records := make([]Record, 0, restoreBatch)
+	for _, item := range items {
+		records = append(records, item.record(false))
+		if len(records) == restoreBatch {
+			wait = db.storage.Append(records)
+			records = make([]Record, 0, restoreBatch)
+		}
+	}
+
+	if len(records) > 0 {
+		wait = db.storage.Append(records)
+	}
+
+	if wait == nil {
+		return nil
+	}
+
+	return wait()
+}
@@ -0,0 +1,83 @@
+package memdb
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabase_BackupRestore(t *testing.T) {
+	RegisterComparator("backup-length", func(a, b string) bool {
+		return len(a) < len(b)
+	})
+
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	index, err := NewRegisteredIndex("by-length", "*", "backup-length")
+	require.Nil(t, err)
+	require.Nil(t, tx.AddIndex(index))
+	for i := 0; i < 1000; i++ {
+		require.Nil(t, tx.Set(strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	require.Nil(t, tx.Commit())
+
+	// Writers continue while the backup is taken
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1000; i < 1100; i++ {
+			tx := db.Begin(true)
+			assert.Nil(t, tx.Set(strconv.Itoa(i), strconv.Itoa(i)))
+			assert.Nil(t, tx.Commit())
+		}
+	}()
+
+	var buf bytes.Buffer
+	require.Nil(t, db.Backup(&buf))
+	wg.Wait()
+
+	os.RemoveAll("test.db")
+	restored, err := OpenDB("test.db", true)
+	require.Nil(t, err)
+	require.Nil(t, restored.Restore(bytes.NewReader(buf.Bytes())))
+	assert.Equal(t, ErrNotEmpty, restored.Restore(bytes.NewReader(buf.Bytes())))
+
+	count, err := restored.Begin(false).Len("by-length")
+	require.Nil(t, err)
+	assert.True(t, count >= 1000 && count <= 1100)
+	require.Nil(t, restored.Close())
+
+	restored, err = OpenDB("test.db", true)
+	require.Nil(t, err)
+	value, err := restored.Begin(false).Get("999")
+	require.Nil(t, err)
+	assert.Equal(t, "999", value)
+}
+
+func TestDatabase_RestoreInvalid(t *testing.T) {
+	db, _ := OpenDB("", false)
+	assert.Equal(t, ErrInvalidSnapshot, db.Restore(bytes.NewReader([]byte("garbage"))))
+
+	source, _ := OpenDB("", false)
+	tx := source.Begin(true)
+	for i := 0; i < 100; i++ {
+		require.Nil(t, tx.Set(strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	require.Nil(t, tx.Commit())
+
+	var buf bytes.Buffer
+	require.Nil(t, source.Backup(&buf))
+
+	// The items of a cut backup are not seen, the whole one is restored after it
+	assert.Equal(t, ErrInvalidSnapshot, db.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()-10])))
+	assert.Equal(t, 0, countKeys(t, db))
+	require.Nil(t, db.Restore(bytes.NewReader(buf.Bytes())))
+	assert.Equal(t, 100, countKeys(t, db))
+}
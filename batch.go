@@ -0,0 +1,120 @@
+package memdb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultMaxBatchSize  = 1000
+	DefaultMaxBatchDelay = 10 * time.Millisecond
+)
+
+var errTrySolo = errors.New("batch function returned an error and should be re-run solo")
+
+// Batch calls fn as part of a write transaction shared with other concurrent Batch callers,
+// so they are committed and written to the log at once. If fn returns an error the shared
+// transaction is rolled back and retried without it, so fn must be idempotent.
+// Batch returns after the transaction with fn is committed.
+func (db *Database) Batch(fn func(*Transaction) error) error {
+	errCh := make(chan error, 1)
+
+	db.batchMu.Lock()
+	if db.batch == nil || len(db.batch.calls) >= db.MaxBatchSize {
+		db.batch = &batch{db: db}
+		db.batch.timer = time.AfterFunc(db.MaxBatchDelay, db.batch.trigger)
+	}
+
+	db.batch.calls = append(db.batch.calls, call{fn: fn, err: errCh})
+	if len(db.batch.calls) >= db.MaxBatchSize {
+		go db.batch.trigger()
+	}
+	db.batchMu.Unlock()
+
+	err := <-errCh
+	if err == errTrySolo {
+		err = db.update(fn)
+	}
+
+	return err
+}
+
+// update runs fn in a write transaction and commits it if fn succeeds
+func (db *Database) update(fn func(*Transaction) error) error {
+	tx := db.Begin(true)
+	if err := safelyCall(fn, tx); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type call struct {
+	fn  func(*Transaction) error
+	err chan<- error
+}
+
+type batch struct {
+	db    *Database
+	timer *time.Timer
+	start sync.Once
+	calls []call
+}
+
+func (b *batch) trigger() {
+	b.start.Do(b.run)
+}
+
+func (b *batch) run() {
+	b.db.batchMu.Lock()
+	b.timer.Stop()
+	if b.db.batch == b {
+		b.db.batch = nil
+	}
+	b.db.batchMu.Unlock()
+
+	for len(b.calls) > 0 {
+		failed := -1
+		err := b.db.update(func(tx *Transaction) error {
+			for i, c := range b.calls {
+				if err := safelyCall(c.fn, tx); err != nil {
+					failed = i
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if failed >= 0 {
+			// Take the failed call out of the batch and let it run solo
+			c := b.calls[failed]
+			b.calls[failed], b.calls = b.calls[len(b.calls)-1], b.calls[:len(b.calls)-1]
+			c.err <- errTrySolo
+			continue
+		}
+
+		for _, c := range b.calls {
+			c.err <- err
+		}
+
+		return
+	}
+}
+
+func safelyCall(fn func(*Transaction) error, tx *Transaction) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	return fn(tx)
+}
@@ -0,0 +1,62 @@
+package memdb
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabase_Batch(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("taken", "value"))
+	require.Nil(t, tx.Commit())
+
+	errFailed := errors.New("failed")
+	errs := make([]error, 100)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Batch(func(tx *Transaction) error {
+				if i == 50 {
+					return errFailed
+				}
+
+				if i == 60 {
+					return tx.Set("taken", "other")
+				}
+
+				return tx.Set(strconv.Itoa(i), "value")
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	tx = db.Begin(false)
+	for i := 0; i < 100; i++ {
+		_, err := tx.Get(strconv.Itoa(i))
+		switch i {
+		case 50:
+			assert.Equal(t, errFailed, errs[i])
+			assert.Equal(t, ErrNotFound, err)
+		case 60:
+			assert.Equal(t, ErrAlreadyExists, errs[i])
+			assert.Equal(t, ErrNotFound, err)
+		default:
+			assert.Nil(t, errs[i])
+			assert.Nil(t, err)
+		}
+	}
+
+	value, err := tx.Get("taken")
+	require.Nil(t, err)
+	assert.Equal(t, "value", value)
+}
@@ -0,0 +1,165 @@
+package memdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// binaryMagic follows the encryption mark at the start of binary log files,
+// its last character is the version of the format
+const binaryMagic = "MEMDBBN1"
+
+// maxBinaryRecord rejects record sizes of a corrupted log that don't fit an int with
+// their length. Smaller ones are not allocated ahead, the buffer of a record grows
+// with the data read.
+const maxBinaryRecord = math.MaxInt32 - binary.MaxVarintLen64
+
+// Commands of binary records
+const (
+	binarySET byte = iota + 1
+	binaryDEL
+	// binarySETCompressed is followed by the name of the compressor after the value
+	binarySETCompressed
+)
+
+// binaryFormat writes records prefixed with their length as a uvarint. A record is
+// the command byte followed by uvarint prefixed key, value and compressor name.
+type binaryFormat struct{}
+
+func uvarintSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+
+	return n
+}
+
+func (binaryFormat) encode(w *bufio.Writer, item *fileItem) error {
+	fields := make([]string, 0, 3)
+	var command byte
+
+	switch {
+	case item.command == commandDEL:
+		command = binaryDEL
+		fields = append(fields, string(item.key))
+	case item.command == commandSET && item.codec == nil:
+		command = binarySET
+		fields = append(fields, string(item.key), item.value)
+	case item.command == commandSET:
+		command = binarySETCompressed
+		fields = append(fields, string(item.key), item.value, item.codec.name)
+	default:
+		panic(fmt.Sprintf("unknwon command %d", item.command))
+	}
+
+	size := 1
+	for _, field := range fields {
+		size += uvarintSize(uint64(len(field))) + len(field)
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], uint64(size))])
+	w.WriteByte(command)
+	for _, field := range fields {
+		w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(field)))])
+		w.WriteString(field)
+	}
+
+	// Errors of the writes above are kept by w and returned by Flush as well
+	_, err := w.Write(nil)
+	return err
+}
+
+func (binaryFormat) magic() string {
+	return binaryMagic
+}
+
+func (binaryFormat) scan(buf []byte) (int, error) {
+	size, n := binary.Uvarint(buf)
+	if n == 0 {
+		return 0, nil
+	}
+	if n < 0 || size == 0 || size > maxBinaryRecord {
+		return 0, ErrCorruptedLog
+	}
+
+	if uint64(len(buf)-n) < size {
+		return 0, nil
+	}
+
+	return n + int(size), nil
+}
+
+func (f binaryFormat) decode(data []byte) ([]fileItem, error) {
+	items := make([]fileItem, 0)
+
+	for len(data) > 0 {
+		size, err := f.scan(data)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, ErrCorruptedLog
+		}
+
+		_, n := binary.Uvarint(data)
+		item, err := decodeBinaryRecord(data[n:size])
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+		data = data[size:]
+	}
+
+	return items, nil
+}
+
+func decodeBinaryRecord(body []byte) (fileItem, error) {
+	item := fileItem{}
+	command, body := body[0], body[1:]
+
+	count := 0
+	switch command {
+	case binarySET:
+		count = 2
+	case binaryDEL:
+		count, item.command = 1, commandDEL
+	case binarySETCompressed:
+		count = 3
+	default:
+		return item, ErrCorruptedLog
+	}
+
+	fields := make([]string, 0, count)
+	for len(fields) < count {
+		size, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < size {
+			return item, ErrCorruptedLog
+		}
+
+		fields = append(fields, string(body[n:n+int(size)]))
+		body = body[n+int(size):]
+	}
+
+	if len(body) != 0 {
+		return item, ErrCorruptedLog
+	}
+
+	item.key = dbKey(fields[0])
+	if count > 1 {
+		item.value = fields[1]
+	}
+
+	if command == binarySETCompressed {
+		if item.codec = getCompressor(fields[2]); item.codec == nil {
+			return item, ErrUnknownCompressor
+		}
+	}
+
+	return item, nil
+}
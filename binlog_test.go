@@ -0,0 +1,51 @@
+package memdb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func BenchmarkLogFormat_Replay(b *testing.B) {
+	const records = 200000
+
+	for _, name := range []string{FormatRESP, FormatBinary} {
+		b.Run(name, func(b *testing.B) {
+			format, err := getFormat(name)
+			require.Nil(b, err)
+
+			path := filepath.Join(b.TempDir(), "bench.db")
+			writeTestLog(b, path, records, fileOptions{format: format})
+
+			info, err := os.Stat(path)
+			require.Nil(b, err)
+			b.SetBytes(info.Size())
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				fs, err := openFileStorage(path, fileOptions{format: format})
+				require.Nil(b, err)
+				require.Nil(b, fs.load(0, func(items []fileItem) error { return nil }))
+				fs.Close()
+			}
+
+			b.ReportMetric(float64(info.Size())/records, "file-bytes/record")
+		})
+	}
+}
+
+func TestBinaryFormat_CorruptedSize(t *testing.T) {
+	var buf [binary.MaxVarintLen64]byte
+
+	// A size that fits waits for more data, a larger one is corrupted
+	size, err := binaryFormat{}.scan(append(buf[:binary.PutUvarint(buf[:], maxBinaryRecord)], binarySET))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
+
+	_, err = binaryFormat{}.scan(append(buf[:binary.PutUvarint(buf[:], maxBinaryRecord+1)], binarySET))
+	assert.Equal(t, ErrCorruptedLog, err)
+}
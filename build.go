@@ -0,0 +1,120 @@
+package memdb
+
+import (
+	"github.com/tidwall/match"
+)
+
+// indexBuildBatch is the number of keys inserted into a building index per write lock
+const indexBuildBatch = 1024
+
+type indexBuild struct {
+	done chan struct{}
+}
+
+// BuildIndex registers index and populates it in background without blocking writers
+// for the whole build. Writes committed during the build are applied to the index
+// as usual. Queries on the index return ErrIndexBuilding until the returned channel is closed.
+// A read-only database returns ErrReadOnly, a follower builds local indexes because
+// it can't get them from the writer otherwise.
+func (db *Database) BuildIndex(index *Index) (<-chan struct{}, error) {
+	build, err := db.registerBuild(index)
+	if err != nil {
+		return nil, err
+	}
+
+	go db.buildIndex(index.name, build)
+
+	return build.done, nil
+}
+
+func (db *Database) registerBuild(index *Index) (*indexBuild, error) {
+	db.writeTx.Lock()
+	defer db.writeTx.Unlock()
+
+	if db.closed {
+		return nil, ErrTxClosed
+	}
+
+	if db.readOnly && db.follower == nil {
+		return nil, ErrReadOnly
+	}
+
+	build := &indexBuild{done: make(chan struct{})}
+	index.building = build
+
+	indexes := db.indexes.fork()
+	if err := indexes.AddIndex(index); err != nil {
+		index.building = nil
+		return nil, err
+	}
+
+	db.setIndexes(indexes.merge())
+
+	return build, nil
+}
+
+func (db *Database) buildIndex(name string, build *indexBuild) {
+	defer close(build.done)
+
+	keys := db.items.keys()
+	for len(keys) > 0 {
+		n := indexBuildBatch
+		if n > len(keys) {
+			n = len(keys)
+		}
+
+		if !db.applyBuild(name, build, keys[:n], false) {
+			return
+		}
+
+		keys = keys[n:]
+	}
+
+	db.applyBuild(name, build, nil, true)
+}
+
+// applyBuild inserts committed values of keys into the building index under the write lock.
+// It returns false if the database was closed or the index was removed meanwhile.
+func (db *Database) applyBuild(name string, build *indexBuild, keys []dbKey, ready bool) bool {
+	db.writeTx.Lock()
+	defer db.writeTx.Unlock()
+
+	if db.closed {
+		return false
+	}
+
+	current := db.indexes.GetIndex(name)
+	if current == nil || current.building != build {
+		return false
+	}
+
+	index := current.clone()
+	for _, key := range keys {
+		if !match.Match(string(key), index.pattern) {
+			continue
+		}
+
+		dbItem := db.items.get(key)
+		if dbItem == nil {
+			continue
+		}
+
+		dbItem.RLock()
+		committed := dbItem.current
+		dbItem.RUnlock()
+
+		if committed != nil {
+			index.insert(committed)
+		}
+	}
+
+	if ready {
+		index.building = nil
+	}
+
+	indexes := db.indexes.fork()
+	indexes.storage[name] = index
+	db.setIndexes(indexes.merge())
+
+	return true
+}
@@ -0,0 +1,99 @@
+package memdb
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabase_BuildIndex(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	for i := 0; i < 3000; i++ {
+		require.Nil(t, tx.Set(strconv.Itoa(i), strconv.Itoa(i%10)))
+	}
+	require.Nil(t, tx.Commit())
+
+	index := NewIndex("by-value", "*", func(a, b string) bool {
+		return a < b
+	})
+
+	build, err := db.registerBuild(index)
+	require.Nil(t, err)
+
+	_, err = db.registerBuild(NewIndex("by-value", "*", nil))
+	assert.Equal(t, ErrIndexExists, err)
+
+	tx = db.Begin(true)
+	assert.Equal(t, ErrIndexBuilding, tx.Ascend("by-value", func(key, value string) bool {
+		return true
+	}))
+	_, err = tx.Len("by-value")
+	assert.Equal(t, ErrIndexBuilding, err)
+
+	require.Nil(t, tx.Set("new", "0"))
+	require.Nil(t, tx.Delete("5"))
+	require.Nil(t, tx.Commit())
+
+	db.buildIndex("by-value", build)
+
+	tx = db.Begin(false)
+	got := make([]string, 0)
+	require.Nil(t, tx.Ascend("by-value", func(key, value string) bool {
+		got = append(got, key)
+		return true
+	}))
+
+	assert.Len(t, got, 3000)
+	assert.Contains(t, got, "new")
+	assert.NotContains(t, got, "5")
+	assert.Equal(t, "0", got[0])
+}
+
+func TestDatabase_BuildIndexBackground(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	for i := 0; i < 5000; i++ {
+		require.Nil(t, tx.Set(strconv.Itoa(i), "value"))
+	}
+	require.Nil(t, tx.Commit())
+
+	done, err := db.BuildIndex(NewIndex("all", "*", func(a, b string) bool {
+		return a < b
+	}))
+	require.Nil(t, err)
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Set("5000", "value"))
+	require.Nil(t, tx.Commit())
+
+	<-done
+
+	length, err := db.Begin(false).Len("all")
+	require.Nil(t, err)
+	assert.Equal(t, 5001, length)
+}
+
+func TestDatabase_BuildIndexRemoved(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "value"))
+	require.Nil(t, tx.Commit())
+
+	build, err := db.registerBuild(NewIndex("all", "*", func(a, b string) bool {
+		return a < b
+	}))
+	require.Nil(t, err)
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.RemoveIndex("all"))
+	require.Nil(t, tx.Commit())
+
+	db.buildIndex("all", build)
+	assert.False(t, db.indexes.Has("all"))
+}
@@ -0,0 +1,283 @@
+// Package client talks to a memdb server over the Redis protocol. Its transactions
+// mirror the embedded API, so code written against DB and Tx runs on an embedded
+// database as well as on a remote one.
+package client
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AplaProject/memdb"
+	"github.com/pkg/errors"
+	"github.com/tidwall/resp"
+)
+
+const (
+	DefaultPoolSize = 8
+	DefaultMaxConns = 64
+)
+
+var ErrClientClosed = errors.New("client closed")
+
+// serverErrors map the error replies of the server to the errors of the database
+var serverErrors = func() map[string]error {
+	errs := make(map[string]error)
+	for _, err := range []error{
+		memdb.ErrNotFound, memdb.ErrAlreadyExists, memdb.ErrTxClosed, memdb.ErrTxNotWritable,
+		memdb.ErrEmptyIndex, memdb.ErrIndexExists, memdb.ErrUnknownIndex, memdb.ErrIndexBuilding,
+		memdb.ErrUnknownComparator, memdb.ErrReadOnly, memdb.ErrClosed,
+	} {
+		errs["ERR "+err.Error()] = err
+	}
+
+	return errs
+}()
+
+// Options of a client. PoolSize is the number of idle connections kept for reuse,
+// MaxConns limits the connections open at once, commands wait for a free one.
+// ReadTimeout and WriteTimeout limit the time to read the replies and write
+// the commands of a round trip, zero values don't time out.
+type Options struct {
+	PoolSize     int
+	MaxConns     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// Client is safe for concurrent use, every command or pipeline takes a connection of
+// the pool and puts it back when the replies are read.
+type Client struct {
+	addr    string
+	options Options
+
+	mu     sync.Mutex
+	freed  *sync.Cond
+	closed bool
+	idle   []*conn
+	// open counts the connections dialed and not closed yet
+	open int
+}
+
+// Dial connects to the server at addr and checks that it answers
+func Dial(addr string, options Options) (*Client, error) {
+	if options.PoolSize <= 0 {
+		options.PoolSize = DefaultPoolSize
+	}
+	if options.MaxConns <= 0 {
+		options.MaxConns = DefaultMaxConns
+	}
+
+	c := &Client{addr: addr, options: options}
+	c.freed = sync.NewCond(&c.mu)
+	if _, err := c.Do("PING"); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close closes the idle connections, connections in use are closed when they are put back
+func (c *Client) Close() error {
+	c.mu.Lock()
+	idle := c.idle
+	c.closed, c.idle = true, nil
+	c.open -= len(idle)
+	c.freed.Broadcast()
+	c.mu.Unlock()
+
+	var err error
+	for _, cn := range idle {
+		if cerr := cn.nc.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Do sends a command and returns its reply, an error reply is returned as an error
+func (c *Client) Do(args ...string) (resp.Value, error) {
+	replies, err := c.roundTrip([][]string{args})
+	if err != nil {
+		return resp.Value{}, err
+	}
+
+	return replies[0], replyErr(replies[0])
+}
+
+// Pipeline returns a pipeline sending commands of the client at once
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Pipeline queues commands until Exec sends them in one write and reads their replies.
+// The commands don't run in one transaction, use MULTI and EXEC for that.
+type Pipeline struct {
+	c    *Client
+	cmds [][]string
+}
+
+// Do queues a command
+func (p *Pipeline) Do(args ...string) {
+	p.cmds = append(p.cmds, args)
+}
+
+// Exec sends the queued commands and returns their replies in order. Error replies are
+// returned as values, the error is set when the replies couldn't be read.
+func (p *Pipeline) Exec() ([]resp.Value, error) {
+	cmds := p.cmds
+	p.cmds = nil
+
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	return p.c.roundTrip(cmds)
+}
+
+func (c *Client) roundTrip(cmds [][]string) ([]resp.Value, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := cn.roundTrip(cmds)
+	c.put(cn, err)
+	return replies, err
+}
+
+// get takes an idle connection or dials a new one, it waits while MaxConns are open
+func (c *Client) get() (*conn, error) {
+	c.mu.Lock()
+	for {
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrClientClosed
+		}
+
+		if n := len(c.idle); n > 0 {
+			cn := c.idle[n-1]
+			c.idle = c.idle[:n-1]
+			c.mu.Unlock()
+			return cn, nil
+		}
+
+		if c.open < c.options.MaxConns {
+			break
+		}
+		c.freed.Wait()
+	}
+	c.open++
+	c.mu.Unlock()
+
+	nc, err := net.DialTimeout("tcp", c.addr, c.options.DialTimeout)
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+
+	wr := bufio.NewWriter(nc)
+	return &conn{
+		nc: nc, rd: resp.NewReader(bufio.NewReader(nc)), wr: wr, w: resp.NewWriter(wr),
+		readTimeout: c.options.ReadTimeout, writeTimeout: c.options.WriteTimeout,
+	}, nil
+}
+
+// put returns cn to the pool. A connection that failed may have unread replies, it is closed.
+func (c *Client) put(cn *conn, err error) {
+	c.mu.Lock()
+	if err == nil && !c.closed && len(c.idle) < c.options.PoolSize {
+		c.idle = append(c.idle, cn)
+		c.freed.Signal()
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	cn.nc.Close()
+	c.release()
+}
+
+// release frees the place of a closed connection
+func (c *Client) release() {
+	c.mu.Lock()
+	c.open--
+	c.freed.Signal()
+	c.mu.Unlock()
+}
+
+// conn is a connection to the server
+type conn struct {
+	nc net.Conn
+	rd *resp.Reader
+	wr *bufio.Writer
+	w  *resp.Writer
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// roundTrip writes the commands at once and reads a reply for each
+func (cn *conn) roundTrip(cmds [][]string) ([]resp.Value, error) {
+	if err := cn.nc.SetWriteDeadline(deadline(cn.writeTimeout)); err != nil {
+		return nil, err
+	}
+
+	for _, args := range cmds {
+		values := make([]resp.Value, len(args))
+		for i, arg := range args {
+			values[i] = resp.StringValue(arg)
+		}
+
+		if err := cn.w.WriteArray(values); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cn.wr.Flush(); err != nil {
+		return nil, err
+	}
+
+	if err := cn.nc.SetReadDeadline(deadline(cn.readTimeout)); err != nil {
+		return nil, err
+	}
+
+	replies := make([]resp.Value, 0, len(cmds))
+	for range cmds {
+		v, _, err := cn.rd.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+
+		replies = append(replies, v)
+	}
+
+	return replies, nil
+}
+
+// deadline returns the deadline of an I/O starting now, zero for no timeout
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(timeout)
+}
+
+// replyErr returns the error of an error reply, errors of the database are returned as
+// their memdb error values
+func replyErr(v resp.Value) error {
+	if v.Type() != resp.Error {
+		return nil
+	}
+
+	if err, found := serverErrors[v.String()]; found {
+		return err
+	}
+
+	return errors.New(v.String())
+}
@@ -0,0 +1,313 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AplaProject/memdb"
+	"github.com/AplaProject/memdb/server"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/resp"
+)
+
+func startServer(t *testing.T) (*memdb.Database, *server.Server, string) {
+	db, err := memdb.OpenDB("", false)
+	require.Nil(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	srv := server.New(db)
+	go srv.Serve(l)
+
+	return db, srv, l.Addr().String()
+}
+
+// testDB runs the same transactions on an embedded and a remote database
+func testDB(t *testing.T, db DB) {
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("user:1", "30"))
+	require.Nil(t, tx.Set("user:2", "9"))
+	require.Nil(t, tx.Set("name", "alice"))
+	assert.Equal(t, memdb.ErrAlreadyExists, tx.Set("user:1", "31"))
+
+	value, err := tx.Get("user:1")
+	require.Nil(t, err)
+	assert.Equal(t, "30", value)
+
+	old, err := tx.Update("name", "bob")
+	require.Nil(t, err)
+	assert.Equal(t, "alice", old)
+	_, err = tx.Update("user:3", "1")
+	assert.Equal(t, memdb.ErrNotFound, err)
+	require.Nil(t, tx.Commit())
+	assert.Equal(t, memdb.ErrTxClosed, tx.Commit())
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Delete("user:1"))
+	assert.Equal(t, memdb.ErrNotFound, tx.Delete("user:1"))
+	require.Nil(t, tx.Rollback())
+
+	tx = db.Begin(false)
+	assert.Equal(t, memdb.ErrTxNotWritable, tx.Set("user:3", "1"))
+	_, err = tx.Get("user:3")
+	assert.Equal(t, memdb.ErrNotFound, err)
+
+	keys := make([]string, 0)
+	require.Nil(t, tx.Ascend("ages", func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	assert.Equal(t, []string{"user:2", "user:1"}, keys)
+	assert.Equal(t, memdb.ErrUnknownIndex, tx.Ascend("unknown", func(key, value string) bool { return true }))
+	require.Nil(t, tx.Commit())
+
+	// An updated value replaces the entry of the key
+	tx = db.Begin(true)
+	_, err = tx.Update("user:2", "100")
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	keys = keys[:0]
+	require.Nil(t, tx.Ascend("ages", func(key, value string) bool {
+		keys = append(keys, key+"="+value)
+		return true
+	}))
+	assert.Equal(t, []string{"user:1=30", "user:2=100"}, keys)
+	require.Nil(t, tx.Commit())
+
+	_, err = tx.Get("user:1")
+	assert.Equal(t, memdb.ErrTxClosed, err)
+}
+
+func TestClient_DB(t *testing.T) {
+	db, err := memdb.OpenDB("", false)
+	require.Nil(t, err)
+	defer db.Close()
+
+	index, err := memdb.NewRegisteredIndex("ages", "user:*", server.ComparatorNumber)
+	require.Nil(t, err)
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(index))
+	require.Nil(t, tx.Commit())
+
+	t.Run("embedded", func(t *testing.T) {
+		testDB(t, Embedded(db))
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		remote, srv, addr := startServer(t)
+		defer remote.Close()
+		defer srv.Close()
+
+		c, err := Dial(addr, Options{})
+		require.Nil(t, err)
+		defer c.Close()
+
+		_, err = c.Do("CREATEINDEX", "ages", "user:*", server.ComparatorNumber)
+		require.Nil(t, err)
+		testDB(t, c)
+	})
+}
+
+func TestClient_Tx(t *testing.T) {
+	db, srv, addr := startServer(t)
+	defer db.Close()
+	defer srv.Close()
+
+	c, err := Dial(addr, Options{PoolSize: 2})
+	require.Nil(t, err)
+	defer c.Close()
+
+	// Writes are not visible to others before Commit
+	tx := c.Begin(true)
+	require.Nil(t, tx.Set("1", "first"))
+	_, err = c.Begin(false).Get("1")
+	assert.Equal(t, memdb.ErrNotFound, err)
+	require.Nil(t, tx.Commit())
+
+	value, err := c.Begin(false).Get("1")
+	require.Nil(t, err)
+	assert.Equal(t, "first", value)
+
+	// Writers wait for each other
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			tx := c.Begin(true)
+			assert.Nil(t, tx.Set("key:"+strconv.Itoa(i), "value"))
+			assert.Nil(t, tx.Commit())
+		}(i)
+	}
+	wg.Wait()
+
+	n, err := c.Do("KEYS", "key:*")
+	require.Nil(t, err)
+	assert.Len(t, n.Array(), 10)
+	assert.True(t, len(c.idle) <= 2)
+
+	// A transaction without commands never reaches the server
+	require.Nil(t, c.Begin(true).Commit())
+}
+
+func TestClient_Pipeline(t *testing.T) {
+	db, srv, addr := startServer(t)
+	defer db.Close()
+	defer srv.Close()
+
+	c, err := Dial(addr, Options{})
+	require.Nil(t, err)
+	defer c.Close()
+
+	p := c.Pipeline()
+	for i := 0; i < 100; i++ {
+		p.Do("SET", "key:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	p.Do("GET", "key:42")
+	p.Do("GET")
+
+	replies, err := p.Exec()
+	require.Nil(t, err)
+	require.Len(t, replies, 102)
+	assert.Equal(t, "OK", replies[0].String())
+	assert.Equal(t, "42", replies[100].String())
+	assert.Equal(t, resp.Error, replies[101].Type())
+
+	replies, err = p.Exec()
+	require.Nil(t, err)
+	assert.Empty(t, replies)
+
+	_, err = c.Do("GET")
+	assert.Error(t, err)
+	_, err = c.Do("DROPINDEX", "unknown")
+	assert.Equal(t, memdb.ErrUnknownIndex, err)
+}
+
+func TestClient_Close(t *testing.T) {
+	db, srv, addr := startServer(t)
+	defer db.Close()
+
+	c, err := Dial(addr, Options{})
+	require.Nil(t, err)
+
+	// The server rolls back the transaction of a lost connection
+	tx := c.Begin(true)
+	require.Nil(t, tx.Set("1", "first"))
+	require.Nil(t, srv.Close())
+	assert.Error(t, tx.Commit())
+
+	_, err = db.Begin(false).Get("1")
+	assert.Equal(t, memdb.ErrNotFound, err)
+
+	require.Nil(t, c.Close())
+	_, err = c.Do("PING")
+	assert.Equal(t, ErrClientClosed, err)
+
+	_, err = Dial(addr, Options{})
+	assert.Error(t, err)
+}
+
+// fakeServer answers PING and fails BEGIN, other commands are sent to cmds unanswered
+func fakeServer(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	cmds := make(chan string, 10)
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer nc.Close()
+				rd, w := resp.NewReader(nc), resp.NewWriter(nc)
+				for {
+					v, _, err := rd.ReadValue()
+					if err != nil {
+						return
+					}
+
+					switch name := v.Array()[0].String(); name {
+					case "PING":
+						w.WriteSimpleString("PONG")
+					case "BEGIN":
+						w.WriteError(errors.New("ERR no transactions"))
+					default:
+						cmds <- name
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), cmds
+}
+
+func TestClient_FailedBegin(t *testing.T) {
+	addr, cmds := fakeServer(t)
+	c, err := Dial(addr, Options{ReadTimeout: time.Second})
+	require.Nil(t, err)
+	defer c.Close()
+
+	// The command isn't sent when BEGIN fails
+	tx := c.Begin(true)
+	assert.EqualError(t, tx.Set("1", "first"), "ERR no transactions")
+	assert.Empty(t, cmds)
+	require.Nil(t, tx.Rollback())
+}
+
+func TestClient_Timeout(t *testing.T) {
+	addr, cmds := fakeServer(t)
+	c, err := Dial(addr, Options{ReadTimeout: 50 * time.Millisecond})
+	require.Nil(t, err)
+	defer c.Close()
+
+	_, err = c.Do("GET", "1")
+	require.Error(t, err)
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	assert.True(t, netErr.Timeout())
+	assert.Equal(t, "GET", <-cmds)
+}
+
+func TestClient_MaxConns(t *testing.T) {
+	db, srv, addr := startServer(t)
+	defer db.Close()
+	defer srv.Close()
+
+	c, err := Dial(addr, Options{MaxConns: 1})
+	require.Nil(t, err)
+	defer c.Close()
+
+	// The command waits for the connection held by the transaction
+	tx := c.Begin(true)
+	require.Nil(t, tx.Set("1", "first"))
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Do("PING")
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("a second connection was opened")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.Nil(t, tx.Commit())
+	assert.Nil(t, <-done)
+	assert.Equal(t, 1, c.open)
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/AplaProject/memdb"
+	"github.com/tidwall/resp"
+)
+
+// Tx is the part of memdb.Transaction served by the server
+type Tx interface {
+	Set(key, value string) error
+	Get(key string) (string, error)
+	Update(key, value string) (string, error)
+	Delete(key string) error
+	Ascend(index string, iterator func(key, value string) bool) error
+	Commit() error
+	Rollback() error
+}
+
+// DB begins transactions of an embedded or a remote database
+type DB interface {
+	Begin(writable bool) Tx
+}
+
+// Embedded returns db as a DB
+func Embedded(db *memdb.Database) DB {
+	return embedded{db}
+}
+
+type embedded struct {
+	db *memdb.Database
+}
+
+func (e embedded) Begin(writable bool) Tx {
+	return e.db.Begin(writable)
+}
+
+// Begin starts a transaction. A writable transaction holds a connection and the write
+// lock of the server from its first command until Commit or Rollback, BEGIN is sent
+// before that command. Each command of a read transaction runs on its own, so it may see
+// the commits made in between.
+func (c *Client) Begin(writable bool) Tx {
+	return &tx{c: c, writable: writable}
+}
+
+type tx struct {
+	c        *Client
+	writable bool
+
+	mu     sync.Mutex
+	closed bool
+	// cn is the connection of a writable transaction after BEGIN, err is set when it failed
+	cn  *conn
+	err error
+}
+
+// do runs a command of the transaction, write tells whether the command writes
+func (tx *tx) do(write bool, args ...string) (resp.Value, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.closed {
+		return resp.Value{}, memdb.ErrTxClosed
+	}
+
+	if write && !tx.writable {
+		return resp.Value{}, memdb.ErrTxNotWritable
+	}
+
+	if !tx.writable {
+		return tx.c.Do(args...)
+	}
+
+	if tx.err != nil {
+		return resp.Value{}, tx.err
+	}
+
+	if tx.cn == nil {
+		if err := tx.begin(); err != nil {
+			return resp.Value{}, err
+		}
+	}
+
+	replies, err := tx.cn.roundTrip([][]string{args})
+	if err != nil {
+		tx.fail(err)
+		return resp.Value{}, err
+	}
+
+	return replies[0], replyErr(replies[0])
+}
+
+// begin takes a connection and sends BEGIN. Its reply is read before the first command
+// is sent, the command would run outside of the transaction if BEGIN failed.
+func (tx *tx) begin() error {
+	cn, err := tx.c.get()
+	if err != nil {
+		return err
+	}
+
+	replies, err := cn.roundTrip([][]string{{"BEGIN"}})
+	if err != nil {
+		tx.c.put(cn, err)
+		return err
+	}
+
+	if err := replyErr(replies[0]); err != nil {
+		tx.c.put(cn, nil)
+		return err
+	}
+
+	tx.cn = cn
+	return nil
+}
+
+// fail drops the connection, the server rolls the transaction back when it is closed
+func (tx *tx) fail(err error) {
+	tx.c.put(tx.cn, err)
+	tx.cn, tx.err = nil, err
+}
+
+// Set creates key, it returns memdb.ErrAlreadyExists if the key exists
+func (tx *tx) Set(key, value string) error {
+	v, err := tx.do(true, "SETNX", key, value)
+	if err != nil {
+		return err
+	}
+
+	if v.Integer() == 0 {
+		return memdb.ErrAlreadyExists
+	}
+
+	return nil
+}
+
+func (tx *tx) Get(key string) (string, error) {
+	v, err := tx.do(false, "GET", key)
+	if err != nil {
+		return "", err
+	}
+
+	if v.IsNull() {
+		return "", memdb.ErrNotFound
+	}
+
+	return v.String(), nil
+}
+
+// Update replaces the value of an existing key and returns the old one
+func (tx *tx) Update(key, value string) (string, error) {
+	v, err := tx.do(true, "SET", key, value, "XX", "GET")
+	if err != nil {
+		return "", err
+	}
+
+	if v.IsNull() {
+		return "", memdb.ErrNotFound
+	}
+
+	return v.String(), nil
+}
+
+func (tx *tx) Delete(key string) error {
+	v, err := tx.do(true, "DEL", key)
+	if err != nil {
+		return err
+	}
+
+	if v.Integer() == 0 {
+		return memdb.ErrNotFound
+	}
+
+	return nil
+}
+
+// Ascend reads the items of index and calls iterator for them in order
+func (tx *tx) Ascend(index string, iterator func(key, value string) bool) error {
+	v, err := tx.do(false, "ASCEND", index)
+	if err != nil {
+		return err
+	}
+
+	items := v.Array()
+	for i := 0; i+1 < len(items); i += 2 {
+		if !iterator(items[i].String(), items[i+1].String()) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (tx *tx) Commit() error {
+	return tx.end("COMMIT")
+}
+
+func (tx *tx) Rollback() error {
+	return tx.end("ROLLBACK")
+}
+
+// end sends COMMIT or ROLLBACK if the transaction began on the server
+func (tx *tx) end(cmd string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.closed {
+		return memdb.ErrTxClosed
+	}
+	tx.closed = true
+
+	if tx.cn == nil {
+		return tx.err
+	}
+
+	replies, err := tx.cn.roundTrip([][]string{{cmd}})
+	tx.c.put(tx.cn, err)
+	tx.cn = nil
+	if err != nil {
+		return err
+	}
+
+	return replyErr(replies[0])
+}
@@ -0,0 +1,48 @@
+// Command memdb-convert converts the log of a database between record formats.
+//
+//	memdb-convert -from resp -to binary data.db data.bin.db
+//
+// The committed state is written to the new log and index definitions to its snapshot.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/AplaProject/memdb"
+)
+
+func main() {
+	from := flag.String("from", memdb.FormatRESP, "record format of the source log")
+	to := flag.String("to", memdb.FormatBinary, "record format of the new log")
+	segmentSize := flag.Int64("segment-size", 0, "rotate the new log into segments of this size")
+	key := flag.String("key", "", "hex encoded encryption key of both logs")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] source destination\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var encryptionKey []byte
+	if *key != "" {
+		var err error
+		if encryptionKey, err = hex.DecodeString(*key); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid key:", err)
+			os.Exit(2)
+		}
+	}
+
+	source := memdb.Config{Format: *from, EncryptionKey: encryptionKey}
+	target := memdb.Config{Format: *to, SegmentSize: *segmentSize, EncryptionKey: encryptionKey}
+	if err := memdb.ConvertLog(flag.Arg(0), source, flag.Arg(1), target); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,101 @@
+// Command memdb-server serves a database to Redis clients.
+//
+//	memdb-server -addr :6379 data.db
+//
+// Without a path the database is kept in memory only. With -follow the server
+// serves reads of a log written by another process. CREATEINDEX orders values
+// with the comparators "string" and "number". With -http the JSON API of package
+// httpapi is served as well. Package client talks to the server from Go.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/AplaProject/memdb"
+	"github.com/AplaProject/memdb/httpapi"
+	"github.com/AplaProject/memdb/server"
+)
+
+func main() {
+	addr := flag.String("addr", ":6379", "TCP address to listen on")
+	httpAddr := flag.String("http", "", "TCP address to serve the HTTP API on")
+	format := flag.String("format", memdb.FormatRESP, "record format of the log")
+	segmentSize := flag.Int64("segment-size", 0, "rotate the log into segments of this size")
+	key := flag.String("key", "", "hex encoded encryption key of the log")
+	readOnly := flag.Bool("read-only", false, "open the log for reading only")
+	follow := flag.Bool("follow", false, "follow the log written by another process")
+	txIdle := flag.Duration("tx-idle-timeout", server.DefaultTxIdleTimeout, "roll back a BEGIN transaction idle for this long")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [path]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() > 1 || (*follow || *readOnly) && flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config := memdb.Config{
+		Persist:     flag.NArg() == 1,
+		Format:      *format,
+		SegmentSize: *segmentSize,
+		ReadOnly:    *readOnly,
+	}
+
+	if *key != "" {
+		var err error
+		if config.EncryptionKey, err = hex.DecodeString(*key); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid key:", err)
+			os.Exit(2)
+		}
+	}
+
+	var db *memdb.Database
+	var err error
+	if *follow {
+		db, err = memdb.Follow(flag.Arg(0), config)
+	} else {
+		db, err = memdb.Open(flag.Arg(0), config)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := server.New(db)
+	srv.TxIdleTimeout = *txIdle
+	var httpSrv *http.Server
+	if *httpAddr != "" {
+		httpSrv = &http.Server{Addr: *httpAddr, Handler: httpapi.NewHandler(db)}
+		go func() {
+			if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		if httpSrv != nil {
+			httpSrv.Close()
+		}
+		srv.Close()
+	}()
+
+	if err := srv.ListenAndServe(*addr); err != server.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
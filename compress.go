@@ -0,0 +1,245 @@
+package memdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// DefaultCompressMinSize is the smallest value compressed when Config.CompressMinSize is not set
+const DefaultCompressMinSize = 512
+
+var (
+	ErrUnknownCompressor = errors.New("unknown compressor")
+	ErrDecompress        = errors.New("decompression failed")
+)
+
+// Compressor compresses values, implementations must be safe for concurrent use
+type Compressor interface {
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// codec is a registered compressor, the name is recorded with compressed log records
+type codec struct {
+	name string
+	Compressor
+}
+
+var compressors = struct {
+	sync.RWMutex
+	storage map[string]*codec
+}{storage: make(map[string]*codec)}
+
+func init() {
+	RegisterCompressor("flate", &flateCompressor{})
+	RegisterCompressor("snappy", snappyCompressor{})
+	RegisterCompressor("zstd", &zstdCompressor{})
+}
+
+// RegisterCompressor makes c available by name for Config.Compression and for reading
+// log records compressed with it. flate, snappy and zstd are registered by the package.
+func RegisterCompressor(name string, c Compressor) {
+	compressors.Lock()
+	compressors.storage[name] = &codec{name: name, Compressor: c}
+	compressors.Unlock()
+}
+
+func getCompressor(name string) *codec {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	return compressors.storage[name]
+}
+
+// flateCompressor is the built-in DEFLATE compressor of the standard library
+type flateCompressor struct {
+	writers sync.Pool
+}
+
+func (fc *flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, ok := fc.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.BestSpeed); err != nil {
+			return nil, err
+		}
+	}
+	defer fc.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (fc *flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// snappyCompressor favours speed over ratio
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// zstdCompressor creates its encoder and decoder on first use, both are safe
+// for concurrent EncodeAll and DecodeAll calls
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (zc *zstdCompressor) init() error {
+	zc.once.Do(func() {
+		if zc.encoder, zc.err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest)); zc.err != nil {
+			return
+		}
+		zc.decoder, zc.err = zstd.NewReader(nil)
+	})
+
+	return zc.err
+}
+
+func (zc *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	if err := zc.init(); err != nil {
+		return nil, err
+	}
+
+	return zc.encoder.EncodeAll(src, nil), nil
+}
+
+func (zc *zstdCompressor) Decompress(src []byte) ([]byte, error) {
+	if err := zc.init(); err != nil {
+		return nil, err
+	}
+
+	return zc.decoder.DecodeAll(src, nil)
+}
+
+// compression applies Config.Compression to values
+type compression struct {
+	codec    *codec
+	minSize  int
+	inMemory bool
+}
+
+func newCompression(config Config) (*compression, error) {
+	if config.Compression == "" {
+		return nil, nil
+	}
+
+	c := getCompressor(config.Compression)
+	if c == nil {
+		return nil, ErrUnknownCompressor
+	}
+
+	minSize := config.CompressMinSize
+	if minSize <= 0 {
+		minSize = DefaultCompressMinSize
+	}
+
+	return &compression{codec: c, minSize: minSize, inMemory: config.CompressInMemory}, nil
+}
+
+// compress returns the compressed value, nil if the value is too small or doesn't shrink
+func (c *compression) compress(value string) []byte {
+	if c == nil || len(value) < c.minSize {
+		return nil
+	}
+
+	compressed, err := c.codec.Compress([]byte(value))
+	if err != nil || len(compressed) >= len(value) {
+		return nil
+	}
+
+	return compressed
+}
+
+// pack compresses the value of i in place if values are kept compressed in memory
+func (c *compression) pack(i *item) {
+	if c == nil || !c.inMemory || i.codec != nil {
+		return
+	}
+
+	if compressed := c.compress(i.value); compressed != nil {
+		i.value = string(compressed)
+		i.codec = c.codec
+	}
+}
+
+// store brings a value read from the log into the form kept in memory. Compressed values
+// are decompressed once to check them, a corrupted one fails with ErrCorruptedLog.
+func (c *compression) store(i *item) error {
+	if i.codec == nil {
+		c.pack(i)
+		return nil
+	}
+
+	plain, err := i.codec.Decompress([]byte(i.value))
+	if err != nil {
+		return ErrCorruptedLog
+	}
+
+	if c == nil || !c.inMemory {
+		i.value, i.codec = string(plain), nil
+	}
+
+	return nil
+}
+
+// plain returns the value of the item, decompressed if it is kept compressed
+func (i *item) plain() (string, error) {
+	if i.codec == nil {
+		return i.value, nil
+	}
+
+	plain, err := i.codec.Decompress([]byte(i.value))
+	if err != nil {
+		return "", ErrDecompress
+	}
+
+	return string(plain), nil
+}
+
+// plainOrEmpty returns the plain value where an error can't be returned, like comparisons
+// of index trees. Values are checked when they are loaded, so it doesn't happen in practice.
+func (i *item) plainOrEmpty() string {
+	value, _ := i.plain()
+	return value
+}
+
+// visit calls iterator with the key and the plain value of i. A value that fails to
+// decompress stops the iteration with its error in err.
+func (i *item) visit(iterator func(key, value string) bool, err *error) bool {
+	value, verr := i.plain()
+	if verr != nil {
+		*err = verr
+		return false
+	}
+
+	return iterator(string(i.key), value)
+}
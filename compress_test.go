@@ -0,0 +1,185 @@
+package memdb
+
+import (
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func document(name string) string {
+	return `{"name":"` + name + `","tags":[` + strings.Repeat(`"tag",`, 200) + `"last"]}`
+}
+
+func TestDatabase_CompressLog(t *testing.T) {
+	for _, name := range []string{"flate", "snappy", "zstd"} {
+		t.Run(name, func(t *testing.T) {
+			testCompressLog(t, name)
+		})
+	}
+}
+
+func testCompressLog(t *testing.T, compressor string) {
+	os.Remove("test.db")
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db", Config{Persist: true, Compression: compressor})
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("doc", document("first")))
+	require.Nil(t, tx.Set("small", "value"))
+	require.Nil(t, tx.Commit())
+
+	// Values are kept plain in memory unless CompressInMemory is set
+	assert.Nil(t, db.items.get("doc").current.codec)
+	require.Nil(t, db.Close())
+
+	info, err := os.Stat("test.db")
+	require.Nil(t, err)
+	assert.True(t, info.Size() < int64(len(document("first"))))
+
+	// Compressed records are read without the compression configured
+	db, err = OpenDB("test.db", true)
+	require.Nil(t, err)
+
+	tx = db.Begin(false)
+	value, err := tx.Get("doc")
+	require.Nil(t, err)
+	assert.Equal(t, document("first"), value)
+	value, err = tx.Get("small")
+	require.Nil(t, err)
+	assert.Equal(t, "value", value)
+	require.Nil(t, db.Close())
+}
+
+func TestDatabase_CompressInMemory(t *testing.T) {
+	os.Remove("test.db")
+	os.Remove("test.db" + SnapshotSuffix)
+	defer os.Remove("test.db")
+	defer os.Remove("test.db" + SnapshotSuffix)
+
+	config := Config{Persist: true, Compression: "flate", CompressInMemory: true}
+	db, err := Open("test.db", config)
+	require.Nil(t, err)
+
+	RegisterComparator("less", func(a, b string) bool {
+		return a < b
+	})
+	index, err := NewRegisteredIndex("values", "*", "less")
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(index))
+	require.Nil(t, tx.AddTextIndex(NewTextIndex("text", "*")))
+	require.Nil(t, tx.Set("b", document("alpha")))
+	require.Nil(t, tx.Set("a", document("beta")))
+	require.Nil(t, tx.Commit())
+
+	stored := db.items.get("a").current
+	assert.NotNil(t, stored.codec)
+	assert.True(t, len(stored.value) < len(document("beta")))
+
+	tx = db.Begin(true)
+	old, err := tx.Update("a", document("gamma"))
+	require.Nil(t, err)
+	assert.Equal(t, document("beta"), old)
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Snapshot("test.db"+SnapshotSuffix))
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Set("c", document("delta")))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Close())
+
+	db, err = Open("test.db", config)
+	require.Nil(t, err)
+
+	for _, key := range []string{"a", "c"} {
+		assert.NotNil(t, db.items.get(dbKey(key)).current.codec)
+	}
+
+	tx = db.Begin(false)
+	got := make([]string, 0)
+	require.Nil(t, tx.Ascend("values", func(key, value string) bool {
+		got = append(got, key+" "+value)
+		return true
+	}))
+	assert.Equal(t, []string{"b " + document("alpha"), "c " + document("delta"), "a " + document("gamma")}, got)
+
+	found := make([]string, 0)
+	require.Nil(t, tx.Search("text", "delta", func(key, value string) bool {
+		found = append(found, key)
+		return true
+	}))
+	assert.Equal(t, []string{"c"}, found)
+	require.Nil(t, db.Close())
+}
+
+func TestDatabase_UnknownCompressor(t *testing.T) {
+	_, err := Open("", Config{Compression: "unknown"})
+	assert.Equal(t, ErrUnknownCompressor, err)
+}
+
+// brokenCompressor fails to decompress while broken is set
+type brokenCompressor struct {
+	flateCompressor
+	broken int32
+}
+
+func (bc *brokenCompressor) Decompress(src []byte) ([]byte, error) {
+	if atomic.LoadInt32(&bc.broken) == 1 {
+		return nil, errors.New("broken")
+	}
+
+	return bc.flateCompressor.Decompress(src)
+}
+
+func TestDatabase_CompressCorrupted(t *testing.T) {
+	os.Remove("test.db")
+	defer os.Remove("test.db")
+
+	broken := &brokenCompressor{}
+	RegisterCompressor("broken", broken)
+	defer atomic.StoreInt32(&broken.broken, 0)
+
+	config := Config{Persist: true, Compression: "broken", CompressInMemory: true}
+	db, err := Open("test.db", config)
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("values", "*", func(a, b string) bool {
+		return a < b
+	})))
+	require.Nil(t, tx.Set("doc", document("first")))
+	require.Nil(t, tx.Commit())
+
+	// Read paths return the error instead of panicking
+	atomic.StoreInt32(&broken.broken, 1)
+	tx = db.Begin(false)
+	_, err = tx.Get("doc")
+	assert.Equal(t, ErrDecompress, err)
+	assert.Equal(t, ErrDecompress, tx.Ascend("values", func(key, value string) bool {
+		return true
+	}))
+	assert.Equal(t, ErrDecompress, tx.Keys("*", func(key, value string) bool {
+		return true
+	}))
+	require.Nil(t, db.Close())
+
+	// Values are checked when the log is loaded
+	for _, inMemory := range []bool{true, false} {
+		config.CompressInMemory = inMemory
+		_, err = Open("test.db", config)
+		assert.Equal(t, ErrCorruptedLog, err)
+	}
+
+	atomic.StoreInt32(&broken.broken, 0)
+	db, err = Open("test.db", config)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+}
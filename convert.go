@@ -0,0 +1,46 @@
+package memdb
+
+// ConvertLog writes the database at src opened with from as a new log at dst opened
+// with to, for example to switch between FormatRESP and FormatBinary or to change the
+// encryption. The committed items are written as set records, so the history of src
+// is not kept, and index definitions go to a snapshot of dst including those with
+// comparators that are not registered. The log at dst must be empty. src is opened
+// read only, so it's left as it is even if it ends with an incomplete record.
+func ConvertLog(src string, from Config, dst string, to Config) error {
+	from.Persist, to.Persist = true, true
+	from.ReadOnly = true
+
+	source, defs, err := open(src, from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := Open(dst, to)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if len(target.items.keys()) > 0 || len(target.indexes.Stats()) > 0 {
+		return ErrNotEmpty
+	}
+
+	items := source.items.committed()
+	if err := target.appendItems(items); err != nil {
+		return err
+	}
+
+	if len(defs) > 0 {
+		offset, err := target.storage.Sync()
+		if err != nil {
+			return err
+		}
+
+		if err := writeSnapshot(dst+SnapshotSuffix, offset, defs, items, target.cipher); err != nil {
+			return err
+		}
+	}
+
+	return target.Close()
+}
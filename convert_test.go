@@ -0,0 +1,81 @@
+package memdb
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertLog(t *testing.T) {
+	removeSegmented("source.db")
+	removeSegmented("target.db")
+	defer removeSegmented("source.db")
+	defer removeSegmented("target.db")
+
+	RegisterComparator("less", func(a, b string) bool {
+		return a < b
+	})
+
+	db, err := OpenDB("source.db", true)
+	require.Nil(t, err)
+
+	index, err := NewRegisteredIndex("values", "*", "less")
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(index))
+	for i := 0; i < 100; i++ {
+		require.Nil(t, tx.Set(strconv.Itoa(i), strconv.Itoa(100-i)))
+	}
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Snapshot("source.db"+SnapshotSuffix))
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Delete("0"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Close())
+
+	target := Config{Format: FormatBinary, SegmentSize: 512}
+	require.Nil(t, ConvertLog("source.db", Config{}, "target.db", target))
+
+	target.Persist = true
+	db, err = Open("target.db", target)
+	require.Nil(t, err)
+
+	assert.Equal(t, 99, countKeys(t, db))
+	length, err := db.Begin(false).Len("values")
+	require.Nil(t, err)
+	assert.Equal(t, 99, length)
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Set("new", "value"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Close())
+
+	assert.Equal(t, ErrNotEmpty, ConvertLog("source.db", Config{}, "target.db", target))
+}
+
+func TestConvertLog_SourceUnchanged(t *testing.T) {
+	removeSegmented("source.db")
+	removeSegmented("target.db")
+	defer removeSegmented("source.db")
+	defer removeSegmented("target.db")
+
+	// The source ends with an incomplete record that a writable open would cut
+	source := []byte("*3\r\n$3\r\nset\r\n$1\r\n1\r\n$1\r\na\r\n*3\r\n$3\r\nset\r\n$1\r\n2\r\n$5\r\nab")
+	require.Nil(t, os.WriteFile("source.db", source, 0666))
+
+	require.Nil(t, ConvertLog("source.db", Config{}, "target.db", Config{Format: FormatBinary}))
+
+	data, err := os.ReadFile("source.db")
+	require.Nil(t, err)
+	assert.Equal(t, source, data)
+
+	db, err := Open("target.db", Config{Persist: true, Format: FormatBinary})
+	require.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, 1, countKeys(t, db))
+}
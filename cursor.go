@@ -0,0 +1,219 @@
+package memdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidToken = errors.New("invalid cursor token")
+
+// Cursor walks over an index of a transaction in both directions. The position is kept
+// as the last seen item, so the cursor stays valid while the index changes and can be
+// restored in another transaction from Token.
+type Cursor struct {
+	tx    *Transaction
+	index string
+	// current is the last item seen. After Resume it has the value the item had when
+	// the token was taken, it may be updated or removed since.
+	current *item
+	err     error
+	// tokens seals the tokens of the cursor, see Database.tokens
+	tokens cipher.AEAD
+}
+
+func (tx *Transaction) Cursor(index string) (*Cursor, error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	if _, err := tx.index(index); err != nil {
+		return nil, err
+	}
+
+	return &Cursor{tx: tx, index: index, tokens: tx.db.tokens}, nil
+}
+
+// Seek moves the cursor to the first item with value greater or equal to value
+func (c *Cursor) Seek(value string) bool {
+	return c.move(func(tree *rankTree) int {
+		return tree.Rank(&item{value: value})
+	})
+}
+
+// Next moves the cursor to the next item, an unpositioned cursor moves to the first item
+func (c *Cursor) Next() bool {
+	return c.move(func(tree *rankTree) int {
+		if c.current == nil {
+			return 0
+		}
+
+		pos := tree.Rank(c.current)
+		if tree.Has(c.current) {
+			pos++
+		}
+
+		return pos
+	})
+}
+
+// Prev moves the cursor to the previous item, an unpositioned cursor moves to the last item
+func (c *Cursor) Prev() bool {
+	return c.move(func(tree *rankTree) int {
+		if c.current == nil {
+			return tree.Len() - 1
+		}
+
+		return tree.Rank(c.current) - 1
+	})
+}
+
+func (c *Cursor) move(position func(tree *rankTree) int) bool {
+	c.tx.mu.RLock()
+	defer c.tx.mu.RUnlock()
+
+	i, err := c.tx.index(c.index)
+	if err != nil {
+		c.err = err
+		return false
+	}
+
+	pos := position(i.tree)
+	found := i.tree.At(pos)
+	if found == nil {
+		return false
+	}
+
+	c.current = found.(*item)
+	return true
+}
+
+func (c *Cursor) Key() string {
+	if c.current == nil {
+		return ""
+	}
+
+	return string(c.current.key)
+}
+
+// Value returns the value of the current item, a value that fails to decompress is
+// returned empty and Err reports the error
+func (c *Cursor) Value() string {
+	if c.current == nil {
+		return ""
+	}
+
+	value, err := c.current.plain()
+	if err != nil {
+		c.err = err
+	}
+
+	return value
+}
+
+// Err returns the error that stopped the cursor
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// newTokenCipher returns the cipher sealing cursor tokens with a random key
+func newTokenCipher() (cipher.AEAD, error) {
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Token returns an opaque position of the cursor. Resume restores it in any transaction
+// of the database until it is closed. The token holds the index, the key and the value
+// of the current item sealed with a key of the open database, so it reveals none of them.
+func (c *Cursor) Token() string {
+	buf := make([]byte, 0)
+	size := make([]byte, binary.MaxVarintLen64)
+
+	value := ""
+	if c.current != nil {
+		value = c.current.plainOrEmpty()
+	}
+
+	for _, field := range []string{c.index, c.Key(), value} {
+		n := binary.PutUvarint(size, uint64(len(field)))
+		buf = append(buf, size[:n]...)
+		buf = append(buf, field...)
+	}
+
+	if c.current == nil {
+		buf = append(buf, 0)
+	} else {
+		buf = append(buf, 1)
+	}
+
+	tokens := c.tokens
+	nonce := make([]byte, tokens.NonceSize(), tokens.NonceSize()+len(buf)+tokens.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(tokens.Seal(nonce, nonce, buf, nil))
+}
+
+// Resume positions the cursor where the token was taken, so Next continues after the
+// item seen then. The position is the value and the key the item had, so changes of
+// the item since don't move the cursor, and Key and Value return them until it moves.
+func (c *Cursor) Resume(token string) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	tokens := c.tokens
+	if len(sealed) < tokens.NonceSize() {
+		return ErrInvalidToken
+	}
+
+	nonce := sealed[:tokens.NonceSize()]
+	buf, err := tokens.Open(nil, nonce, sealed[len(nonce):], nil)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	fields := make([]string, 0, 3)
+	for len(fields) < 3 {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < size {
+			return ErrInvalidToken
+		}
+
+		fields = append(fields, string(buf[n:n+int(size)]))
+		buf = buf[n+int(size):]
+	}
+
+	if len(buf) != 1 || fields[0] != c.index {
+		return ErrInvalidToken
+	}
+
+	c.tx.mu.RLock()
+	defer c.tx.mu.RUnlock()
+
+	if _, err := c.tx.index(c.index); err != nil {
+		return err
+	}
+
+	c.current = nil
+	if buf[0] == 1 {
+		c.current = &item{key: dbKey(fields[1]), value: fields[2]}
+	}
+
+	return nil
+}
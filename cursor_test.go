@@ -0,0 +1,148 @@
+package memdb
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor_Walk(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("items", "*", numericLess)))
+	for i := 0; i < 10; i++ {
+		require.Nil(t, tx.Set(strconv.Itoa(i), strconv.Itoa(i*10)))
+	}
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	c, err := tx.Cursor("items")
+	require.Nil(t, err)
+
+	require.True(t, c.Next())
+	assert.Equal(t, "0", c.Key())
+	assert.Equal(t, "0", c.Value())
+
+	require.True(t, c.Seek("45"))
+	assert.Equal(t, "5", c.Key())
+	require.True(t, c.Next())
+	assert.Equal(t, "6", c.Key())
+	require.True(t, c.Prev())
+	require.True(t, c.Prev())
+	assert.Equal(t, "4", c.Key())
+
+	assert.False(t, c.Seek("1000"))
+	assert.Equal(t, "4", c.Key())
+
+	c, err = tx.Cursor("items")
+	require.Nil(t, err)
+	require.True(t, c.Prev())
+	assert.Equal(t, "9", c.Key())
+	assert.False(t, c.Next())
+	assert.Nil(t, c.Err())
+
+	_, err = tx.Cursor("unknown")
+	assert.Equal(t, ErrUnknownIndex, err)
+	require.Nil(t, tx.Commit())
+
+	// An updated item is visited once at its new value
+	tx = db.Begin(true)
+	_, err = tx.Update("5", "95")
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	c, err = tx.Cursor("items")
+	require.Nil(t, err)
+
+	keys := make([]string, 0)
+	for c.Next() {
+		keys = append(keys, c.Key())
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "6", "7", "8", "9", "5"}, keys)
+}
+
+func TestCursor_Token(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("items", "*", numericLess)))
+	for i := 0; i < 10; i++ {
+		require.Nil(t, tx.Set(strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	c, err := tx.Cursor("items")
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		require.True(t, c.Next())
+	}
+	token := c.Token()
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Delete("2"))
+	require.Nil(t, tx.Delete("3"))
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	c, err = tx.Cursor("items")
+	require.Nil(t, err)
+	require.Nil(t, c.Resume(token))
+	require.True(t, c.Next())
+	assert.Equal(t, "4", c.Key())
+
+	require.True(t, c.Prev())
+	assert.Equal(t, "1", c.Key())
+
+	assert.Equal(t, ErrInvalidToken, c.Resume("%%%"))
+
+	other, err := tx.Cursor("items")
+	require.Nil(t, err)
+	require.Nil(t, other.Resume(other.Token()))
+	require.True(t, other.Next())
+	assert.Equal(t, "0", other.Key())
+	require.Nil(t, tx.Commit())
+
+	// An item updated since the token was taken doesn't move the cursor
+	tx = db.Begin(false)
+	c, err = tx.Cursor("items")
+	require.Nil(t, err)
+	require.True(t, c.Seek("4"))
+	token = c.Token()
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(true)
+	_, err = tx.Update("4", "123456789")
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	c, err = tx.Cursor("items")
+	require.Nil(t, err)
+	require.Nil(t, c.Resume(token))
+	require.True(t, c.Next())
+	assert.Equal(t, "5", c.Key())
+
+	require.Nil(t, c.Resume(token))
+	require.True(t, c.Prev())
+	assert.Equal(t, "1", c.Key())
+
+	// Tokens are sealed, they reveal nothing and only the database open can read them
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	require.Nil(t, err)
+	assert.NotContains(t, string(raw), "items")
+
+	otherDB, _ := OpenDB("", false)
+	otherTx := otherDB.Begin(true)
+	require.Nil(t, otherTx.AddIndex(NewIndex("items", "*", numericLess)))
+	c, err = otherTx.Cursor("items")
+	require.Nil(t, err)
+	assert.Equal(t, ErrInvalidToken, c.Resume(token))
+	require.Nil(t, otherTx.Commit())
+}
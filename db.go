@@ -1,7 +1,9 @@
 package memdb
 
 import (
+	"crypto/cipher"
 	"sync"
+	"time"
 
 	"github.com/tidwall/btree"
 )
@@ -11,6 +13,8 @@ type dbKey string
 type item struct {
 	key   dbKey
 	value string
+	// codec is set when value is kept compressed
+	codec *codec
 }
 
 type dbItem struct {
@@ -25,10 +29,11 @@ func (i *item) Less(bitem btree.Item, ctx interface{}) bool {
 	i2 := bitem.(*item)
 	index, ok := ctx.(*Index)
 	if ok {
-		if index.sortFn(i.value, i2.value) {
+		a, b := i.plainOrEmpty(), i2.plainOrEmpty()
+		if index.sortFn(a, b) {
 			return true
 		}
-		if index.sortFn(i2.value, i.value) {
+		if index.sortFn(b, a) {
 			return false
 		}
 	}
@@ -36,14 +41,70 @@ func (i *item) Less(bitem btree.Item, ctx interface{}) bool {
 	return i.key < i2.key
 }
 
+type keyItem dbKey
+
+func (k keyItem) Less(bitem btree.Item, ctx interface{}) bool {
+	return k < bitem.(keyItem)
+}
+
 type Items struct {
 	mu      sync.RWMutex
 	storage map[dbKey]*dbItem
+	// keyspace keeps keys of storage ordered for scans
+	keyspace *btree.BTree
+	// copies are the copies of the committed items being made, copying counts them
+	copies  map[*itemsCopy]struct{}
+	copying int32
+}
+
+func newItems() Items {
+	return Items{
+		storage:  make(map[dbKey]*dbItem),
+		keyspace: btree.New(btreeDegrees, nil),
+	}
 }
 
 func (it *Items) set(key dbKey, item *dbItem) {
 	it.mu.Lock()
 	it.storage[key] = item
+	it.keyspace.ReplaceOrInsert(keyItem(key))
+	it.mu.Unlock()
+}
+
+func (it *Items) setMany(items []*dbItem) {
+	it.mu.Lock()
+	for _, item := range items {
+		it.storage[item.key] = item
+		it.keyspace.ReplaceOrInsert(keyItem(item.key))
+	}
+	it.mu.Unlock()
+}
+
+// apply replays log records as committed items
+func (it *Items) apply(records []fileItem) {
+	it.mu.Lock()
+	for i := range records {
+		record := &records[i]
+
+		it.preserve(record.key)
+
+		if record.command == commandSET {
+			it.storage[record.key] = &dbItem{key: record.key, current: &record.item}
+			it.keyspace.ReplaceOrInsert(keyItem(record.key))
+		}
+
+		if record.command == commandDEL {
+			delete(it.storage, record.key)
+			it.keyspace.Delete(keyItem(record.key))
+		}
+	}
+	it.mu.Unlock()
+}
+
+// replace takes the items of other
+func (it *Items) replace(other *Items) {
+	it.mu.Lock()
+	it.storage, it.keyspace = other.storage, other.keyspace
 	it.mu.Unlock()
 }
 
@@ -56,9 +117,29 @@ func (it *Items) get(key dbKey) *dbItem {
 func (it *Items) remove(key dbKey) {
 	it.mu.Lock()
 	delete(it.storage, key)
+	it.keyspace.Delete(keyItem(key))
 	it.mu.Unlock()
 }
 
+// ascend returns at most limit ordered keys starting from the key from
+func (it *Items) ascend(from dbKey, inclusive bool, limit int) []dbKey {
+	keys := make([]dbKey, 0, limit)
+
+	it.mu.RLock()
+	it.keyspace.AscendGreaterOrEqual(keyItem(from), func(bitem btree.Item) bool {
+		key := dbKey(bitem.(keyItem))
+		if !inclusive && key == from {
+			return true
+		}
+
+		keys = append(keys, key)
+		return len(keys) < limit
+	})
+	it.mu.RUnlock()
+
+	return keys
+}
+
 func (it *Items) keys() []dbKey {
 	keys := make([]dbKey, 0)
 
@@ -72,48 +153,167 @@ func (it *Items) keys() []dbKey {
 }
 
 type Database struct {
+	// MaxBatchSize is the maximum number of calls grouped by Batch into one transaction
+	MaxBatchSize int
+	// MaxBatchDelay is the maximum time Batch waits for other calls before committing
+	MaxBatchDelay time.Duration
+
 	writeTx sync.Mutex
+	batchMu sync.Mutex
+	batch   *batch
+
+	items Items
+	// indexes are replaced under writeTx and indexesMu, never modified in place
+	indexesMu sync.RWMutex
+	indexes   *Indexes
 
-	items   Items
-	indexes *Indexes
+	closed      bool
+	readOnly    bool
+	path        string
+	storage     Storage
+	cipher      *logCipher
+	compression *compression
+	follower    *follower
+	// tokens seals cursor tokens with a key of the open database
+	tokens cipher.AEAD
+}
 
-	closed            bool
-	persist           bool
-	persistentStorage *fileStorage
+// Config controls how Open persists the database
+type Config struct {
+	// Persist writes commits to the log at the path of the database
+	Persist bool
+	// Storage keeps the log instead of the file at path, snapshots are still kept at path
+	Storage Storage
+	// Format is the record format of the log file, FormatRESP if empty. Binary files
+	// start with a mark of the format, a log in another format returns ErrFormatMismatch.
+	Format string
+	// ReadOnly opens an existing log for reading only and without the lock, so other
+	// processes can open it too. Begin(true) returns transactions refusing changes.
+	// A writable log file is locked against other writers until the database is closed.
+	ReadOnly bool
+	// SegmentSize rotates the log to a new numbered segment once the active one reaches
+	// this size. Zero keeps the log in a single file.
+	SegmentSize int64
+	// EncryptionKey encrypts the log and snapshots with AES-GCM, its size selects
+	// AES-128, AES-192 or AES-256
+	EncryptionKey []byte
+	// KeyProvider supplies rotating encryption keys instead of EncryptionKey
+	KeyProvider KeyProvider
+	// Compression names the registered compressor of values in the log, "flate", "snappy"
+	// and "zstd" are built in. Others are added with RegisterCompressor.
+	Compression string
+	// CompressMinSize is the smallest value compressed, DefaultCompressMinSize if zero
+	CompressMinSize int
+	// CompressInMemory keeps large values compressed in memory as well. They are
+	// decompressed on every read and every comparison of an index on values.
+	CompressInMemory bool
+	// FollowInterval is how often Follow checks the log for new records,
+	// DefaultFollowInterval if zero
+	FollowInterval time.Duration
 }
 
 func OpenDB(path string, persist bool) (*Database, error) {
+	return Open(path, Config{Persist: persist})
+}
+
+// Open opens the database at path with config. Indexes of the snapshot are restored
+// if their comparators are registered with RegisterComparator before, others are
+// dropped and later snapshots store only the definitions of the restored ones.
+func Open(path string, config Config) (*Database, error) {
+	db, defs, err := open(path, config)
+	if err != nil {
+		return nil, err
+	}
+
+	db.restoreIndexes(defs)
+	return db, nil
+}
+
+// open loads the database and returns the index definitions of the loaded snapshot
+func open(path string, config Config) (*Database, []indexDef, error) {
+	db, err := newDatabase(path, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if db.storage == nil {
+		return db, nil, nil
+	}
+
+	start, end := db.storage.Bounds()
+	offset, defs := db.loadSnapshot(path, start, end)
+
+	err = db.storage.Replay(offset, db.apply)
+	if err != nil {
+		// Release the lock of a log that fails to load, storages of config stay open
+		if config.Storage == nil {
+			db.storage.Close()
+		}
+		return nil, nil, err
+	}
+
+	return db, defs, nil
+}
+
+// newDatabase returns an empty database with the storage of config opened
+func newDatabase(path string, config Config) (*Database, error) {
 	db := &Database{
-		items:   Items{storage: make(map[dbKey]*dbItem)},
-		indexes: newIndexer(),
+		MaxBatchSize:  DefaultMaxBatchSize,
+		MaxBatchDelay: DefaultMaxBatchDelay,
+
+		items:    newItems(),
+		indexes:  newIndexer(),
+		path:     path,
+		readOnly: config.ReadOnly,
+	}
+
+	var err error
+	db.cipher, err = newLogCipher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	db.compression, err = newCompression(config)
+	if err != nil {
+		return nil, err
+	}
+
+	db.tokens, err = newTokenCipher()
+	if err != nil {
+		return nil, err
 	}
 
-	if persist {
-		var err error
-		db.persist = true
-		db.persistentStorage, err = openFileStorage(path)
+	db.storage = config.Storage
+	if db.storage == nil && config.Persist {
+		db.storage, err = openConfiguredStorage(path, config, db.cipher, db.compression)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		records := db.persistentStorage.read()
-		for record := range records {
-			if record.err != nil {
-				return nil, err
-			}
+	return db, nil
+}
 
-			if record.item.command == commandSET {
-				dbItem := &dbItem{key: record.item.key, current: &record.item.item}
-				db.items.set(dbItem.key, dbItem)
-			}
+// apply applies replayed records, values are brought into the form kept in memory
+func (db *Database) apply(records []Record) error {
+	items := make([]fileItem, len(records))
+	for i, record := range records {
+		item, err := record.fileItem()
+		if err != nil {
+			return err
+		}
 
-			if record.item.command == commandDEL {
-				db.items.remove(record.item.key)
+		if item.command == commandSET {
+			if err := db.compression.store(&item.item); err != nil {
+				return err
 			}
 		}
+
+		items[i] = item
 	}
 
-	return db, nil
+	db.items.apply(items)
+	return nil
 }
 
 func (db *Database) Close() error {
@@ -121,28 +321,57 @@ func (db *Database) Close() error {
 		return nil
 	}
 
-	err := db.persistentStorage.close()
-	if err != nil {
-		return err
+	db.unfollow()
+	if db.storage != nil {
+		if err := db.storage.Close(); err != nil {
+			return err
+		}
 	}
 
 	db.closed = true
-	db.items = Items{storage: make(map[dbKey]*dbItem)}
-	db.indexes = newIndexer()
+	db.items = newItems()
+	db.setIndexes(newIndexer())
 
 	return nil
 }
 
+// committedIndexes returns the indexes of the last commit to callers without the write lock
+func (db *Database) committedIndexes() *Indexes {
+	db.indexesMu.RLock()
+	defer db.indexesMu.RUnlock()
+	return db.indexes
+}
+
+func (db *Database) setIndexes(indexes *Indexes) {
+	db.indexesMu.Lock()
+	db.indexes = indexes
+	db.indexesMu.Unlock()
+}
+
+// LogStats returns write statistics of the persistence log
+func (db *Database) LogStats() LogStats {
+	if db.storage == nil {
+		return LogStats{}
+	}
+
+	return db.storage.Stats()
+}
+
+// Indexes returns stats of the committed indexes ordered by name
+func (db *Database) Indexes() []IndexStats {
+	return db.committedIndexes().Stats()
+}
+
 func (db *Database) Begin(writable bool) *Transaction {
 	tx := &Transaction{
 		db: db,
 	}
 
-	if writable {
+	if writable && !db.readOnly {
 		db.writeTx.Lock()
 		tx.writable = true
 		tx.pendingItems = make(map[dbKey]struct{})
-		tx.newIndexes = db.indexes.Copy()
+		tx.newIndexes = db.indexes.fork()
 	}
 
 	return tx
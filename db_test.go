@@ -3,6 +3,7 @@ package memdb
 import (
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,7 +14,7 @@ func TestDB_FileImport(t *testing.T) {
 	path := "test.db"
 	os.RemoveAll(path)
 
-	fs, err := openFileStorage(path)
+	fs, err := openFileStorage(path, fileOptions{})
 	require.Nil(t, err)
 
 	err = fs.write([]fileItem{
@@ -23,7 +24,7 @@ func TestDB_FileImport(t *testing.T) {
 	}...)
 
 	require.Nil(t, err)
-	err = fs.close()
+	err = fs.Close()
 	require.Nil(t, err)
 
 	db, err := OpenDB("test.db", true)
@@ -36,6 +37,7 @@ func TestDB_FileImport(t *testing.T) {
 	value, err := tx.Get("FIRSTKEY")
 	assert.Nil(t, err)
 	assert.Equal(t, "THIRDVALUE", value)
+	require.Nil(t, db.Close())
 }
 
 func BenchmarkDatabaseSet(b *testing.B) {
@@ -57,3 +59,86 @@ func BenchmarkDatabaseSet(b *testing.B) {
 		require.Nil(b, err)
 	}
 }
+
+func BenchmarkDatabaseSmallWriteManyIndexes(b *testing.B) {
+	b.ReportAllocs()
+	db, err := OpenDB("", false)
+	require.Nil(b, err)
+
+	tx := db.Begin(true)
+	for i := 0; i < 100; i++ {
+		prefix := strconv.FormatInt(int64(i), 10)
+		require.Nil(b, tx.AddIndex(NewIndex(prefix, prefix+".*", func(a, c string) bool {
+			return a < c
+		})))
+	}
+	for i := 0; i < 100; i++ {
+		prefix := strconv.FormatInt(int64(i), 10)
+		for n := 0; n < 1000; n++ {
+			require.Nil(b, tx.Set(prefix+"."+strconv.FormatInt(int64(n), 10), "somevalue"))
+		}
+	}
+	require.Nil(b, tx.Commit())
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tx := db.Begin(true)
+		if err := tx.Set("0.new"+strconv.FormatInt(int64(n), 10), "somevalue"); err != nil {
+			require.Nil(b, err)
+		}
+		if err := tx.Commit(); err != nil {
+			require.Nil(b, err)
+		}
+	}
+}
+
+func TestDatabase_ReadOnly(t *testing.T) {
+	removeSegmented("readonly.db")
+	defer removeSegmented("readonly.db")
+
+	_, err := Open("readonly.db", Config{Persist: true, ReadOnly: true})
+	assert.True(t, os.IsNotExist(err))
+
+	db, err := OpenDB("readonly.db", true)
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "value"))
+	require.Nil(t, tx.Commit())
+
+	_, err = OpenDB("readonly.db", true)
+	assert.Equal(t, ErrLocked, err)
+
+	// Readers don't take the lock of the writer
+	reader, err := Open("readonly.db", Config{Persist: true, ReadOnly: true})
+	require.Nil(t, err)
+
+	value, err := reader.Begin(false).Get("1")
+	require.Nil(t, err)
+	assert.Equal(t, "value", value)
+
+	tx = reader.Begin(true)
+	assert.Equal(t, ErrTxNotWritable, tx.Set("2", "value"))
+	require.Nil(t, tx.Rollback())
+
+	assert.Equal(t, ErrReadOnly, reader.Shrink())
+	assert.Equal(t, ErrReadOnly, reader.Restore(strings.NewReader("")))
+	_, err = reader.BuildIndex(NewIndex("values", "*", func(a, b string) bool {
+		return a < b
+	}))
+	assert.Equal(t, ErrReadOnly, err)
+	require.Nil(t, reader.Close())
+
+	// The lock is released on Close
+	require.Nil(t, db.Close())
+	db, err = OpenDB("readonly.db", true)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	// A log that fails to load doesn't keep the lock
+	require.Nil(t, os.WriteFile("readonly.db", []byte("*3\r\n#garbage\r\n"), 0666))
+	_, err = OpenDB("readonly.db", true)
+	assert.Equal(t, ErrCorruptedLog, err)
+	_, err = OpenDB("readonly.db", true)
+	assert.Equal(t, ErrCorruptedLog, err)
+}
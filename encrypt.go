@@ -0,0 +1,331 @@
+package memdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// encryptedMagic starts every encrypted log segment and snapshot
+const encryptedMagic = "MEMDBEN1"
+
+// frameHeaderSize is the size of the ciphertext length and the key id preceding a frame
+const frameHeaderSize = 8
+
+// maxFramePlain is the most plaintext written to one frame
+const maxFramePlain = logBufferSize
+
+// maxFrameSize is the size of the largest sealed frame written, a larger size read
+// from a frame header is corrupted and isn't allocated
+const maxFrameSize = maxFramePlain + 16
+
+var (
+	ErrEncrypted    = errors.New("file is encrypted")
+	ErrNotEncrypted = errors.New("file is not encrypted")
+	ErrDecrypt      = errors.New("decryption failed")
+)
+
+// KeyProvider supplies AES keys of 16, 24 or 32 bytes for the encryption of the log.
+// Frames record the id of their key, so older keys must stay available until the
+// files encrypted with them are removed by Shrink.
+type KeyProvider interface {
+	// CurrentKey returns the key new frames are encrypted with.
+	// It is asked again when Shrink rotates the key.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with id to decrypt existing frames
+	Key(id uint32) ([]byte, error)
+}
+
+// staticKey provides the single key of Config.EncryptionKey
+type staticKey []byte
+
+func (k staticKey) CurrentKey() (uint32, []byte, error) {
+	return 0, k, nil
+}
+
+func (k staticKey) Key(id uint32) ([]byte, error) {
+	if id != 0 {
+		return nil, ErrDecrypt
+	}
+
+	return k, nil
+}
+
+// logCipher encrypts data as frames of AES-GCM with a random nonce:
+// ciphertext length, key id, nonce and the sealed data. The length, the key id and
+// the position of the frame in its file are authenticated as additional data, so frames
+// moved, dropped or copied inside a file fail to decrypt. Only frames cut off the end
+// go unnoticed, like an interrupted write. A nil logCipher leaves data in plaintext.
+type logCipher struct {
+	provider KeyProvider
+
+	mu      sync.Mutex
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+func newLogCipher(config Config) (*logCipher, error) {
+	provider := config.KeyProvider
+	if provider == nil {
+		if config.EncryptionKey == nil {
+			return nil, nil
+		}
+
+		provider = staticKey(config.EncryptionKey)
+	}
+
+	c := &logCipher{provider: provider, aeads: make(map[uint32]cipher.AEAD)}
+	if err := c.rotateKey(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// rotateKey switches new frames to the current key of the provider
+func (c *logCipher) rotateKey() error {
+	id, key, err := c.provider.CurrentKey()
+	if err != nil {
+		return err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.current = id
+	c.aeads[id] = aead
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *logCipher) aead(id uint32) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aead, ok := c.aeads[id]; ok {
+		return aead, nil
+	}
+
+	key, err := c.provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// frameAD returns the additional data of a frame with header at offset of its file
+func frameAD(header []byte, offset int64) []byte {
+	ad := make([]byte, frameHeaderSize+8)
+	copy(ad, header)
+	binary.BigEndian.PutUint64(ad[frameHeaderSize:], uint64(offset))
+	return ad
+}
+
+// seal returns p encrypted as one frame with the current key to be written at offset
+func (c *logCipher) seal(p []byte, offset int64) ([]byte, error) {
+	c.mu.Lock()
+	id, aead := c.current, c.aeads[c.current]
+	c.mu.Unlock()
+
+	nonceSize := aead.NonceSize()
+	frame := make([]byte, frameHeaderSize+nonceSize, frameHeaderSize+nonceSize+len(p)+aead.Overhead())
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(p)+aead.Overhead()))
+	binary.BigEndian.PutUint32(frame[4:8], id)
+
+	nonce := frame[frameHeaderSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(frame, nonce, p, frameAD(frame[:frameHeaderSize], offset)), nil
+}
+
+// writeHeader marks w as the start of an encrypted file
+func (c *logCipher) writeHeader(w io.Writer) error {
+	if c == nil {
+		return nil
+	}
+
+	_, err := w.Write([]byte(encryptedMagic))
+	return err
+}
+
+// headerSize returns the size of the mark at the start of an encrypted file
+func (c *logCipher) headerSize() int64 {
+	if c == nil {
+		return 0
+	}
+
+	return int64(len(encryptedMagic))
+}
+
+// writer returns a writer encrypting every write to w as a frame, offset is the position
+// of w in its file
+func (c *logCipher) writer(w io.Writer, offset int64) io.Writer {
+	if c == nil {
+		return w
+	}
+
+	return &frameWriter{cipher: c, w: w, offset: offset}
+}
+
+// reader returns a reader of the plaintext of r, offset is the position of r in its file.
+// At offset zero the encrypted file mark is verified first. An incomplete frame at
+// the end of r reads as the end of data.
+func (c *logCipher) reader(r io.Reader, offset int64) (io.Reader, error) {
+	if c == nil {
+		return r, nil
+	}
+
+	if offset == 0 {
+		mark := make([]byte, len(encryptedMagic))
+		if _, err := io.ReadFull(r, mark); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return &frameReader{cipher: c, r: r}, nil
+			}
+			return nil, err
+		}
+
+		if string(mark) != encryptedMagic {
+			return nil, ErrNotEncrypted
+		}
+		offset = c.headerSize()
+	}
+
+	return &frameReader{cipher: c, r: r, offset: offset}, nil
+}
+
+// checkEncryption verifies that file is encrypted if and only if c is set
+func (c *logCipher) checkEncryption(file *os.File) error {
+	mark := make([]byte, len(encryptedMagic))
+	n, err := file.ReadAt(mark, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	encrypted := n == len(mark) && string(mark) == encryptedMagic
+	if c == nil && encrypted {
+		return ErrEncrypted
+	}
+	if c != nil && n > 0 && !encrypted {
+		return ErrNotEncrypted
+	}
+
+	return nil
+}
+
+type frameWriter struct {
+	cipher *logCipher
+	w      io.Writer
+	// offset is the position of the next frame in the file
+	offset int64
+}
+
+// Write writes p as frames of at most maxFramePlain bytes,
+// each in a single write to the underlying writer
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		size := len(p) - written
+		if size > maxFramePlain {
+			size = maxFramePlain
+		}
+
+		frame, err := fw.cipher.seal(p[written:written+size], fw.offset)
+		if err != nil {
+			return written, err
+		}
+
+		if _, err := fw.w.Write(frame); err != nil {
+			return written, err
+		}
+
+		fw.offset += int64(len(frame))
+		written += size
+	}
+
+	return written, nil
+}
+
+type frameReader struct {
+	cipher *logCipher
+	r      io.Reader
+	plain  []byte
+	// offset is the position of the next frame in the file
+	offset int64
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for len(fr.plain) == 0 {
+		if err := fr.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, fr.plain)
+	fr.plain = fr.plain[n:]
+	return n, nil
+}
+
+func (fr *frameReader) next() error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxFrameSize {
+		return ErrCorruptedLog
+	}
+
+	aead, err := fr.cipher.aead(binary.BigEndian.Uint32(header[4:8]))
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, aead.NonceSize()+int(size))
+	if _, err := io.ReadFull(fr.r, frame); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		return err
+	}
+
+	nonce, sealed := frame[:aead.NonceSize()], frame[aead.NonceSize():]
+	fr.plain, err = aead.Open(sealed[:0], nonce, sealed, frameAD(header[:], fr.offset))
+	if err != nil {
+		return ErrDecrypt
+	}
+
+	fr.offset += int64(frameHeaderSize + len(frame))
+	return nil
+}
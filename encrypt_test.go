@@ -0,0 +1,208 @@
+package memdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testKeys struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (k *testKeys) CurrentKey() (uint32, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *testKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, errors.New("unknown key")
+	}
+
+	return key, nil
+}
+
+func TestDatabase_Encryption(t *testing.T) {
+	removeSegmented("encrypted.db")
+	defer removeSegmented("encrypted.db")
+
+	key := bytes.Repeat([]byte{1}, 32)
+	db, err := Open("encrypted.db", Config{Persist: true, EncryptionKey: key})
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "secret value"))
+	require.Nil(t, tx.Set("2", "other secret"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Snapshot("encrypted.db"+SnapshotSuffix))
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Delete("2"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Close())
+
+	for _, file := range []string{"encrypted.db", "encrypted.db" + SnapshotSuffix} {
+		data, err := os.ReadFile(file)
+		require.Nil(t, err)
+		assert.True(t, bytes.HasPrefix(data, []byte(encryptedMagic)))
+		assert.False(t, bytes.Contains(data, []byte("secret")))
+	}
+
+	// An interrupted frame at the end of the log is ignored
+	f, err := os.OpenFile("encrypted.db", os.O_APPEND|os.O_WRONLY, 0666)
+	require.Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 0, 0})
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	db, err = Open("encrypted.db", Config{Persist: true, EncryptionKey: key})
+	require.Nil(t, err)
+
+	value, err := db.Begin(false).Get("1")
+	require.Nil(t, err)
+	assert.Equal(t, "secret value", value)
+	_, err = db.Begin(false).Get("2")
+	assert.Equal(t, ErrNotFound, err)
+	require.Nil(t, db.Close())
+
+	_, err = OpenDB("encrypted.db", true)
+	assert.Equal(t, ErrEncrypted, err)
+	_, err = Open("encrypted.db", Config{Persist: true, EncryptionKey: key, Format: FormatBinary})
+	assert.Equal(t, ErrFormatMismatch, err)
+
+	os.Remove("encrypted.db" + SnapshotSuffix)
+	_, err = Open("encrypted.db", Config{Persist: true, EncryptionKey: bytes.Repeat([]byte{2}, 32)})
+	assert.Equal(t, ErrDecrypt, err)
+}
+
+func TestDatabase_EncryptedFrameOrder(t *testing.T) {
+	removeSegmented("encrypted.db")
+	defer removeSegmented("encrypted.db")
+
+	config := Config{Persist: true, EncryptionKey: bytes.Repeat([]byte{1}, 32)}
+	db, err := Open("encrypted.db", config)
+	require.Nil(t, err)
+
+	// Every commit is a frame of the same size
+	for i := 0; i < 3; i++ {
+		tx := db.Begin(true)
+		require.Nil(t, tx.Set(strconv.Itoa(i), "value"))
+		require.Nil(t, tx.Commit())
+	}
+	require.Nil(t, db.Close())
+
+	data, err := os.ReadFile("encrypted.db")
+	require.Nil(t, err)
+	header, frames := data[:len(encryptedMagic)], data[len(encryptedMagic):]
+	size := len(frames) / 3
+	frame := func(i int) []byte { return frames[i*size : (i+1)*size] }
+
+	for name, order := range map[string][]int{
+		"swapped":  {1, 0, 2},
+		"dropped":  {0, 2},
+		"replayed": {0, 1, 1},
+	} {
+		log := append([]byte{}, header...)
+		for _, i := range order {
+			log = append(log, frame(i)...)
+		}
+		require.Nil(t, os.WriteFile("encrypted.db", log, 0666))
+
+		_, err = Open("encrypted.db", config)
+		assert.Equal(t, ErrDecrypt, err, name)
+	}
+
+	// Frames cut off the end are lost like an interrupted write
+	require.Nil(t, os.WriteFile("encrypted.db", append(append([]byte{}, header...), frame(0)...), 0666))
+	db, err = Open("encrypted.db", config)
+	require.Nil(t, err)
+	assert.Equal(t, 1, countKeys(t, db))
+	require.Nil(t, db.Close())
+}
+
+func TestDatabase_EncryptionKeyRotation(t *testing.T) {
+	removeSegmented("rotation.db")
+	defer removeSegmented("rotation.db")
+
+	keys := &testKeys{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 16)}}
+	db, err := Open("rotation.db", Config{Persist: true, SegmentSize: 512, KeyProvider: keys})
+	require.Nil(t, err)
+
+	for i := 0; i < 30; i++ {
+		tx := db.Begin(true)
+		require.Nil(t, tx.Set(strconv.Itoa(i), "value"))
+		require.Nil(t, tx.Commit())
+	}
+
+	keys.current = 2
+	keys.keys[2] = bytes.Repeat([]byte{2}, 16)
+	require.Nil(t, db.Shrink())
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("new", "value"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Close())
+
+	// Files written with the old key are gone after Shrink
+	delete(keys.keys, 1)
+
+	db, err = Open("rotation.db", Config{Persist: true, KeyProvider: keys})
+	require.Nil(t, err)
+	assert.Equal(t, 31, countKeys(t, db))
+	require.Nil(t, db.Close())
+}
+
+func TestLogCipher_PlaintextLog(t *testing.T) {
+	os.Remove("test.db")
+	defer os.Remove("test.db")
+
+	db, err := OpenDB("test.db", true)
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "value"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Close())
+
+	_, err = Open("test.db", Config{Persist: true, EncryptionKey: bytes.Repeat([]byte{1}, 16)})
+	assert.Equal(t, ErrNotEncrypted, err)
+
+	_, err = Open("test.db", Config{Persist: true, EncryptionKey: []byte("short")})
+	assert.NotNil(t, err)
+}
+
+func TestLogCipher_FrameSize(t *testing.T) {
+	c, err := newLogCipher(Config{EncryptionKey: bytes.Repeat([]byte{1}, 16)})
+	require.Nil(t, err)
+
+	// A large write is split into frames no larger than the reader accepts
+	plain := bytes.Repeat([]byte("v"), 3*maxFramePlain+5)
+	var buf bytes.Buffer
+	n, err := c.writer(&buf, c.headerSize()).Write(plain)
+	require.Nil(t, err)
+	assert.Equal(t, len(plain), n)
+	assert.Equal(t, 4*(frameHeaderSize+12)+len(plain)+4*16, buf.Len())
+
+	r, err := c.reader(bytes.NewReader(buf.Bytes()), c.headerSize())
+	require.Nil(t, err)
+	got, err := io.ReadAll(r)
+	require.Nil(t, err)
+	assert.Equal(t, plain, got)
+
+	// A corrupted frame size is refused before its frame is allocated
+	corrupted := append([]byte{}, buf.Bytes()...)
+	binary.BigEndian.PutUint32(corrupted[0:4], maxFrameSize+1)
+	r, err = c.reader(bytes.NewReader(corrupted), c.headerSize())
+	require.Nil(t, err)
+	_, err = io.ReadAll(r)
+	assert.Equal(t, ErrCorruptedLog, err)
+}
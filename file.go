@@ -1,18 +1,123 @@
 package memdb
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 	"github.com/tidwall/resp"
 )
 
-var ErrOpenFile = errors.New("opening file")
+var (
+	ErrOpenFile = errors.New("opening file")
+	ErrReadOnly = errors.New("database is read-only")
+	ErrLocked   = errors.New("database is locked by another process")
+	// ErrLockUnsupported is returned opening a writable log where files can't be locked
+	ErrLockUnsupported = errors.New("file locking is not supported on this platform")
+	// ErrLogFailed is returned by commits after a failed write couldn't be cut off the log
+	ErrLogFailed = errors.New("log write failed")
+)
+
+// logBufferSize is the size of the log write buffer, it is flushed at commit boundaries
+const logBufferSize = 64 * 1024
+
+// LogStats reports write activity of the persistence log
+type LogStats struct {
+	// Commits is the number of committed transactions written to the log
+	Commits int64
+	// Records is the number of set and del records
+	Records int64
+	// PayloadBytes is the size of keys and values of the records
+	PayloadBytes int64
+	// BytesWritten is the size of the data written to the file
+	BytesWritten int64
+	// Writes is the number of write syscalls
+	Writes int64
+	// Syncs is the number of fsync calls
+	Syncs int64
+}
+
+// WriteAmplification returns the ratio of bytes written to the file to the payload size
+func (s LogStats) WriteAmplification() float64 {
+	if s.PayloadBytes == 0 {
+		return 0
+	}
+
+	return float64(s.BytesWritten) / float64(s.PayloadBytes)
+}
+
+// countingWriter counts write syscalls and bytes going to the file
+type countingWriter struct {
+	w      io.Writer
+	writes int64
+	bytes  int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(&cw.writes, 1)
+	atomic.AddInt64(&cw.bytes, int64(n))
+	return n, err
+}
 
 type fileStorage struct {
+	path string
 	file *os.File
+
+	// A writable log holds the lock on the file at path through lock,
+	// a read-only one is opened without it
+	readOnly bool
+	lock     *os.File
+	// tail reads a read-only log written by another process, see Follow
+	tail *logTail
+
+	// Segment state. Without a manifest the log is the single segment at path.
+	// activeSize is the size of the last segment, the one file is open for.
+	segMu       sync.Mutex
+	segmented   bool
+	segmentSize int64
+	segments    []segment
+	activeSize  int64
+	accounted   int64
+
+	// Records are encoded into buf, which is flushed to out only at commit boundaries.
+	// With encryption sink seals every flush of buf as a frame before it goes to out.
+	format logFormat
+	cipher *logCipher
+	out    *countingWriter
+	sink   io.Writer
+	buf    *bufio.Writer
+
+	// compression compresses large values written to the log, compressed values are
+	// recorded as set with the name of the compressor after the value
+	compression *compression
+
+	commits int64
+	records int64
+	payload int64
+	syncs   int64
+
+	// Group commit state. Commits are queued in order and the first waiter
+	// writes and syncs everything queued so far in a single I/O.
+	mu       sync.Mutex
+	flushed  *sync.Cond
+	queue    []*commitRequest
+	flushing bool
+	// failed is set when a partial write stays in the file, no more commits are written
+	failed error
+}
+
+type commitRequest struct {
+	items []fileItem
+	// rotate switches to the current encryption key and a new segment after the write
+	rotate bool
+	done   bool
+	err    error
 }
 
 type command int8
@@ -27,18 +132,177 @@ type fileItem struct {
 	command command
 }
 
-func openFileStorage(path string) (*fileStorage, error) {
-	var err error
-	fs := &fileStorage{}
+// logFormat encodes records of the log file
+type logFormat interface {
+	// encode writes the record of item to w
+	encode(w *bufio.Writer, item *fileItem) error
+	// scan returns the size of the record at the start of buf
+	// or zero if buf doesn't contain the whole record
+	scan(buf []byte) (int, error)
+	// decode returns the records of data, which contains whole records only
+	decode(data []byte) ([]fileItem, error)
+	// magic returns the mark of the format written after the encryption mark
+	// at the start of every file, empty if the format has none
+	magic() string
+}
 
-	fs.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
+// Record formats of the log file
+const (
+	// FormatRESP writes records as RESP arrays, readable with redis tools
+	FormatRESP = "resp"
+	// FormatBinary writes length-prefixed binary records, which are smaller and faster to replay
+	FormatBinary = "binary"
+)
+
+var (
+	ErrUnknownFormat  = errors.New("unknown log format")
+	ErrFormatMismatch = errors.New("log file is written in another format")
+)
+
+func getFormat(name string) (logFormat, error) {
+	switch name {
+	case "", FormatRESP:
+		return respFormat{}, nil
+	case FormatBinary:
+		return binaryFormat{}, nil
+	}
+
+	return nil, ErrUnknownFormat
+}
+
+// fileOptions configures a file log, zero values keep a single plain RESP file
+type fileOptions struct {
+	format logFormat
+	// segmentSize rotates the log into numbered segments listed in a manifest,
+	// an existing manifest is always followed
+	segmentSize int64
+	cipher      *logCipher
+	compression *compression
+	// readOnly opens existing files for reading without taking the lock
+	readOnly bool
+}
+
+// openFileStorage opens the log at path
+func openFileStorage(path string, options fileOptions) (*fileStorage, error) {
+	c := options.cipher
+	fs := &fileStorage{
+		path:        path,
+		format:      options.format,
+		segmentSize: options.segmentSize,
+		cipher:      c,
+		compression: options.compression,
+		readOnly:    options.readOnly,
+	}
+	if fs.format == nil {
+		fs.format = respFormat{}
+	}
+	fs.flushed = sync.NewCond(&fs.mu)
+
+	if err := fs.open(); err != nil {
+		fs.Close()
 		return nil, err
 	}
 
+	fs.out = &countingWriter{w: fs.file}
+	fs.sink = c.writer(fs.out, fs.activeSize)
+	fs.buf = bufio.NewWriterSize(fs.sink, logBufferSize)
+
 	return fs, nil
 }
 
+func (fs *fileStorage) open() error {
+	var err error
+	if !fs.readOnly {
+		if fs.lock, err = lockFile(fs.path); err != nil {
+			return err
+		}
+	}
+
+	segments, err := readManifest(fs.path)
+	if err != nil {
+		return err
+	}
+
+	fs.segmented = segments != nil || fs.segmentSize > 0 && !fs.readOnly
+	if segments == nil {
+		segments = []segment{{id: 0, base: 0, path: fs.path}}
+		if fs.segmented {
+			if err := writeManifest(fs.path, segments); err != nil {
+				return err
+			}
+		}
+	}
+	fs.segments = segments
+
+	flag := os.O_CREATE | os.O_RDWR
+	if fs.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	fs.file, err = os.OpenFile(segments[len(segments)-1].path, flag, 0666)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.checkHeader(fs.file); err != nil {
+		return err
+	}
+
+	info, err := fs.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	fs.activeSize = info.Size()
+	if fs.activeSize == 0 && !fs.readOnly {
+		if _, err := io.WriteString(fs.file, fs.header()); err != nil {
+			return err
+		}
+		fs.activeSize = fs.headerSize()
+	}
+
+	return nil
+}
+
+// header returns the encryption mark and the format mark starting every file of the log
+func (fs *fileStorage) header() string {
+	header := fs.format.magic()
+	if fs.cipher != nil {
+		header = encryptedMagic + header
+	}
+
+	return header
+}
+
+func (fs *fileStorage) headerSize() int64 {
+	return int64(len(fs.header()))
+}
+
+// checkHeader verifies that file is encrypted if and only if the log is and that
+// a file with records has the mark of the format of the log
+func (fs *fileStorage) checkHeader(file *os.File) error {
+	if err := fs.cipher.checkEncryption(file); err != nil {
+		return err
+	}
+
+	magic := fs.format.magic()
+	mark := make([]byte, len(binaryMagic))
+	n, err := file.ReadAt(mark, fs.cipher.headerSize())
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	if magic == "" && string(mark[:n]) == binaryMagic || magic != "" && string(mark[:n]) != magic {
+		return ErrFormatMismatch
+	}
+
+	return nil
+}
+
 type readResult struct {
 	item fileItem
 	err  error
@@ -48,67 +312,367 @@ func (fs *fileStorage) read() chan *readResult {
 	results := make(chan *readResult)
 
 	go func() {
-		rd := resp.NewReader(fs.file)
+		defer close(results)
 
-		for {
-			result := readResult{}
-			v, _, err := rd.ReadValue()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				result.err = err
-				break
-			}
+		_, err := fs.file.Seek(fs.headerSize(), io.SeekStart)
+		var r io.Reader
+		if err == nil {
+			r, err = fs.cipher.reader(fs.file, fs.headerSize())
+		}
+		if err == nil {
+			err = splitRecords(r, fs.format.scan, nil, func(data []byte) bool {
+				items, err := fs.format.decode(data)
+				if err != nil {
+					results <- &readResult{err: err}
+					return false
+				}
 
-			if v.Type() == resp.Array {
-				for i, v := range v.Array() {
-					switch i {
-					case 0:
-						command := v.String()
-						if command == "set" {
-							result.item.command = commandSET
-						} else if command == "del" {
-							result.item.command = commandDEL
-						}
-					case 1:
-						result.item.key = dbKey(v.String())
-					case 2:
-						result.item.value = v.String()
-					}
+				for _, item := range items {
+					results <- &readResult{item: item}
 				}
-				results <- &result
-			}
+				return true
+			})
 		}
 
-		close(results)
+		if err != nil {
+			results <- &readResult{err: err}
+		}
 	}()
 
 	return results
 }
 
+// respFormat writes records as RESP arrays: set, key, value and the compressor name
+// of a compressed value, or del and key
+type respFormat struct{}
+
+func (respFormat) encode(w *bufio.Writer, item *fileItem) error {
+	row := make([]resp.Value, 0, 4)
+
+	if item.command == commandSET {
+		row = append(row, resp.StringValue("set"), resp.StringValue(string(item.key)), resp.StringValue(item.value))
+		if item.codec != nil {
+			row = append(row, resp.StringValue(item.codec.name))
+		}
+	} else if item.command == commandDEL {
+		row = append(row, resp.StringValue("del"), resp.StringValue(string(item.key)))
+	} else {
+		panic(fmt.Sprintf("unknwon command %d", item.command))
+	}
+
+	return resp.NewWriter(w).WriteArray(row)
+}
+
+// magic is empty, so RESP logs stay readable with redis tools
+func (respFormat) magic() string {
+	return ""
+}
+
+func (respFormat) scan(buf []byte) (int, error) {
+	return scanRecord(buf)
+}
+
+func (respFormat) decode(data []byte) ([]fileItem, error) {
+	items := make([]fileItem, 0)
+	rd := resp.NewReader(bytes.NewReader(data))
+
+	for {
+		v, _, err := rd.ReadValue()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		item, ok, err := decodeRecord(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			items = append(items, item)
+		}
+	}
+}
+
+// decodeRecord returns the record of v, a compressed value keeps the codec it was written with
+func decodeRecord(v resp.Value) (fileItem, bool, error) {
+	item := fileItem{}
+	if v.Type() != resp.Array {
+		return item, false, nil
+	}
+
+	for i, v := range v.Array() {
+		switch i {
+		case 0:
+			command := v.String()
+			if command == "set" {
+				item.command = commandSET
+			} else if command == "del" {
+				item.command = commandDEL
+			}
+		case 1:
+			item.key = dbKey(v.String())
+		case 2:
+			item.value = v.String()
+		case 3:
+			if item.codec = getCompressor(v.String()); item.codec == nil {
+				return item, false, ErrUnknownCompressor
+			}
+		}
+	}
+
+	return item, true, nil
+}
+
+// Sync waits until all enqueued commits are written and returns the end of the log.
+// A followed log returns the position read up to.
+func (fs *fileStorage) Sync() (int64, error) {
+	if fs.tail != nil {
+		return fs.tail.applied, nil
+	}
+
+	if fs.readOnly {
+		return fs.end(), nil
+	}
+
+	if err := fs.wait(fs.enqueue(nil)); err != nil {
+		return 0, err
+	}
+
+	return fs.end(), nil
+}
+
+// Snapshot waits until all enqueued commits are written, then switches to the current
+// encryption key and a new segment, so later records don't depend on earlier files.
+// It returns the end of the log.
+func (fs *fileStorage) Snapshot() (int64, error) {
+	if fs.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if err := fs.wait(fs.push(&commitRequest{rotate: true})); err != nil {
+		return 0, err
+	}
+
+	return fs.end(), nil
+}
+
+// enqueue adds items to the next group commit, requests must be enqueued in commit order
+func (fs *fileStorage) enqueue(items []fileItem) *commitRequest {
+	return fs.push(&commitRequest{items: items})
+}
+
+func (fs *fileStorage) push(req *commitRequest) *commitRequest {
+	fs.mu.Lock()
+	fs.queue = append(fs.queue, req)
+	fs.mu.Unlock()
+
+	return req
+}
+
+// wait returns when items of req are written and synced to disk
+func (fs *fileStorage) wait(req *commitRequest) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for !req.done {
+		if fs.flushing {
+			fs.flushed.Wait()
+			continue
+		}
+
+		group := fs.queue
+		fs.queue = nil
+		fs.flushing = true
+		fs.mu.Unlock()
+
+		err := fs.flush(group)
+
+		fs.mu.Lock()
+		for _, r := range group {
+			r.err = err
+			r.done = true
+		}
+		fs.flushing = false
+		fs.flushed.Broadcast()
+	}
+
+	return req.err
+}
+
+// flush writes and syncs the records of group. Records of a group that failed to reach
+// the disk are cut off the file, so the log never keeps a part of a commit.
+func (fs *fileStorage) flush(group []*commitRequest) error {
+	if fs.failed != nil {
+		return fs.failed
+	}
+
+	start := fs.activeSize
+	rotate := false
+	for _, req := range group {
+		rotate = rotate || req.rotate
+		if err := fs.encode(req.items...); err != nil {
+			return fs.discard(start, err)
+		}
+	}
+
+	if err := fs.commitBoundary(int64(len(group))); err != nil {
+		return fs.discard(start, err)
+	}
+
+	atomic.AddInt64(&fs.syncs, 1)
+	if err := fs.file.Sync(); err != nil {
+		return fs.discard(start, err)
+	}
+
+	if rotate && fs.cipher != nil {
+		if err := fs.cipher.rotateKey(); err != nil {
+			return err
+		}
+	}
+
+	full := fs.segmentSize > 0 && fs.activeSize >= fs.segmentSize
+	if fs.segmented && (full || rotate && fs.activeSize > fs.headerSize()) {
+		return fs.rotate()
+	}
+
+	return nil
+}
+
 func (fs *fileStorage) write(items ...fileItem) error {
-	writer := resp.NewWriter(fs.file)
+	if fs.failed != nil {
+		return fs.failed
+	}
 
-	for _, item := range items {
-		row := make([]resp.Value, 0)
+	start := fs.activeSize
+	if err := fs.encode(items...); err != nil {
+		return fs.discard(start, err)
+	}
+
+	if err := fs.commitBoundary(1); err != nil {
+		return fs.discard(start, err)
+	}
+
+	return nil
+}
+
+// commitBoundary flushes buffered records of commits to the file
+func (fs *fileStorage) commitBoundary(commits int64) error {
+	err := fs.buf.Flush()
+	fs.account()
+
+	if err != nil {
+		fs.buf.Reset(fs.sink)
+		return err
+	}
+
+	atomic.AddInt64(&fs.commits, commits)
+	return nil
+}
+
+// account adds the bytes written to the file to the size of the active segment.
+// Bytes of a failed flush may have reached the file as well.
+func (fs *fileStorage) account() {
+	written := atomic.LoadInt64(&fs.out.bytes)
+	fs.segMu.Lock()
+	fs.activeSize += written - fs.accounted
+	fs.accounted = written
+	fs.segMu.Unlock()
+}
+
+// discard drops the buffered records of a failed write and cuts the file back to start.
+// If the file can't be cut, later commits return ErrLogFailed instead of following
+// a partial record.
+func (fs *fileStorage) discard(start int64, err error) error {
+	fs.buf.Reset(fs.sink)
+	fs.account()
+
+	if cerr := fs.cut(start); cerr != nil {
+		fs.failed = ErrLogFailed
+	}
+
+	return err
+}
 
-		if item.command == commandSET {
-			row = append(row, resp.StringValue("set"), resp.StringValue(string(item.key)), resp.StringValue(item.value))
-		} else if item.command == commandDEL {
-			row = append(row, resp.StringValue("del"), resp.StringValue(string(item.key)))
-		} else {
-			panic(fmt.Sprintf("unknwon command %d", item.command))
+// cut truncates the active segment at end and continues writing there
+func (fs *fileStorage) cut(end int64) error {
+	fs.segMu.Lock()
+	defer fs.segMu.Unlock()
+
+	if end >= fs.activeSize {
+		return nil
+	}
+
+	if err := fs.file.Truncate(end); err != nil {
+		return err
+	}
+
+	if _, err := fs.file.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+
+	fs.activeSize = end
+	fs.resetSink()
+	return nil
+}
+
+// resetSink drops buffered records and writes the next frame at the end of the active segment
+func (fs *fileStorage) resetSink() {
+	fs.sink = fs.cipher.writer(fs.out, fs.activeSize)
+	fs.buf.Reset(fs.sink)
+}
+
+func (fs *fileStorage) encode(items ...fileItem) error {
+	for _, item := range items {
+		if item.command == commandSET && item.codec == nil {
+			if compressed := fs.compression.compress(item.value); compressed != nil {
+				item.value = string(compressed)
+				item.codec = fs.compression.codec
+			}
 		}
 
-		if err := writer.WriteArray(row); err != nil {
+		if err := fs.format.encode(fs.buf, &item); err != nil {
 			return err
 		}
+
+		atomic.AddInt64(&fs.records, 1)
+		atomic.AddInt64(&fs.payload, int64(len(item.key)+len(item.value)))
 	}
 
 	return nil
 }
 
-func (fs *fileStorage) close() error {
-	return fs.file.Close()
+func (fs *fileStorage) Stats() LogStats {
+	return LogStats{
+		Commits:      atomic.LoadInt64(&fs.commits),
+		Records:      atomic.LoadInt64(&fs.records),
+		PayloadBytes: atomic.LoadInt64(&fs.payload),
+		BytesWritten: atomic.LoadInt64(&fs.out.bytes),
+		Writes:       atomic.LoadInt64(&fs.out.writes),
+		Syncs:        atomic.LoadInt64(&fs.syncs),
+	}
+}
+
+func (fs *fileStorage) Close() error {
+	var err error
+	if fs.file != nil {
+		err = fs.file.Close()
+	}
+
+	if fs.tail != nil {
+		if terr := fs.tail.close(); err == nil {
+			err = terr
+		}
+	}
+
+	if fs.lock != nil {
+		if lerr := fs.lock.Close(); err == nil {
+			err = lerr
+		}
+		fs.lock = nil
+	}
+
+	return err
 }
@@ -1,16 +1,20 @@
 package memdb
 
 import (
+	"io"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestFileStorage_ReadWrite(t *testing.T) {
 	os.RemoveAll("test.db")
-	fs, err := openFileStorage("test.db")
+	fs, err := openFileStorage("test.db", fileOptions{})
 	assert.Nil(t, err)
 
 	err = fs.write([]fileItem{
@@ -20,10 +24,11 @@ func TestFileStorage_ReadWrite(t *testing.T) {
 	}...)
 	assert.Nil(t, err)
 
-	fs.close()
+	fs.Close()
 
-	fs, err = openFileStorage("test.db")
+	fs, err = openFileStorage("test.db", fileOptions{})
 	assert.Nil(t, err)
+	defer fs.Close()
 
 	items := fs.read()
 	got := make([]fileItem, 0)
@@ -38,3 +43,106 @@ func TestFileStorage_ReadWrite(t *testing.T) {
 		{command: commandSET, item: item{key: "3", value: "test3"}},
 	}, got)
 }
+
+func TestFileStorage_GroupCommit(t *testing.T) {
+	os.RemoveAll("test.db")
+	fs, err := openFileStorage("test.db", fileOptions{})
+	require.Nil(t, err)
+
+	first := fs.enqueue([]fileItem{{item: item{key: "1", value: "test1"}, command: commandSET}})
+	second := fs.enqueue([]fileItem{{item: item{key: "2", value: "test2"}, command: commandSET}})
+
+	require.Nil(t, fs.wait(second))
+	assert.True(t, first.done)
+	assert.Nil(t, fs.wait(first))
+	require.Nil(t, fs.Close())
+
+	fs, err = openFileStorage("test.db", fileOptions{})
+	require.Nil(t, err)
+	defer fs.Close()
+
+	got := make([]dbKey, 0)
+	for result := range fs.read() {
+		require.Nil(t, result.err)
+		got = append(got, result.item.key)
+	}
+	assert.Equal(t, []dbKey{"1", "2"}, got)
+}
+
+func TestFileStorage_BufferedWrites(t *testing.T) {
+	os.RemoveAll("test.db")
+	db, err := OpenDB("test.db", true)
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	for i := 0; i < 10000; i++ {
+		require.Nil(t, tx.Set(strconv.Itoa(i), "value"))
+	}
+	require.Nil(t, tx.Commit())
+
+	stats := db.LogStats()
+	assert.Equal(t, int64(1), stats.Commits)
+	assert.Equal(t, int64(10000), stats.Records)
+	assert.Equal(t, int64(1), stats.Syncs)
+	assert.True(t, stats.Writes < 10, "writes: %d", stats.Writes)
+	assert.True(t, stats.WriteAmplification() > 1)
+
+	info, err := os.Stat("test.db")
+	require.Nil(t, err)
+	assert.Equal(t, info.Size(), stats.BytesWritten)
+	require.Nil(t, db.Close())
+}
+
+// failingWriter writes up to n bytes, then fails
+type failingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.n {
+		n, _ := fw.w.Write(p[:fw.n])
+		fw.n -= n
+		return n, errors.New("disk full")
+	}
+
+	fw.n -= len(p)
+	return fw.w.Write(p)
+}
+
+func TestFileStorage_FailedWrite(t *testing.T) {
+	os.RemoveAll("test.db")
+	fs, err := openFileStorage("test.db", fileOptions{})
+	require.Nil(t, err)
+
+	first := fileItem{item: item{key: "1", value: "first"}, command: commandSET}
+	require.Nil(t, fs.wait(fs.enqueue([]fileItem{first})))
+
+	// The group is larger than the write buffer and fails after a part reached the file
+	items := make([]fileItem, 0)
+	for i := 0; i < 100; i++ {
+		items = append(items, fileItem{item: item{key: dbKey(strconv.Itoa(i)), value: strings.Repeat("v", 2048)}, command: commandSET})
+	}
+	fs.out.w = &failingWriter{w: fs.file, n: logBufferSize + 100}
+	assert.Error(t, fs.wait(fs.enqueue(items)))
+
+	// Later commits follow the last whole one
+	fs.out.w = fs.file
+	second := fileItem{item: item{key: "2", value: "second"}, command: commandSET}
+	require.Nil(t, fs.wait(fs.enqueue([]fileItem{second})))
+	require.Nil(t, fs.Close())
+
+	fs, err = openFileStorage("test.db", fileOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, []fileItem{first, second}, loadAll(t, fs))
+
+	// A log that can't be cut refuses further commits
+	file := fs.file
+	fs.file, err = os.Open("test.db")
+	require.Nil(t, err)
+	fs.out.w = &failingWriter{w: file, n: 10}
+	assert.Error(t, fs.wait(fs.enqueue([]fileItem{first})))
+	assert.Equal(t, ErrLogFailed, fs.wait(fs.enqueue([]fileItem{second})))
+	require.Nil(t, fs.Close())
+	require.Nil(t, file.Close())
+}
@@ -0,0 +1,443 @@
+package memdb
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultFollowInterval is how often a follower checks the log when Config.FollowInterval is not set
+const DefaultFollowInterval = 100 * time.Millisecond
+
+// tailCheckSize is the number of bytes before the last whole record a follower compares
+// with the file on every poll, to notice when the writer cut records it applied
+const tailCheckSize = 4096
+
+// ErrLogCut stops a follower when the writer cut records off the log that were applied already
+var ErrLogCut = errors.New("followed log was cut before records applied")
+
+type follower struct {
+	tail *logTail
+	stop chan struct{}
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// Follow opens the log at path written by another process and keeps applying records
+// appended to it to the database and its indexes until the database is closed.
+// The log is opened read-only whatever Persist, ReadOnly and Storage of config are,
+// the rest of config must match the writer. Indexes of the snapshot are restored
+// and BuildIndex adds local ones.
+//
+// Records are applied as soon as they are read, so a commit larger than the write
+// buffer of the writer can become visible partially. A follower lagging behind
+// the writer stops with ErrMissingSegment once the segments it needs are compacted,
+// FollowErr reports the error.
+//
+// A writer cuts an incomplete record off the log when it opens it after a crash, and
+// the records of a commit that failed. The follower reads again from its last whole
+// record then. If records it applied were cut, it stops with ErrLogCut.
+func Follow(path string, config Config) (*Database, error) {
+	config.Persist, config.ReadOnly, config.Storage = true, true, nil
+
+	db, err := newDatabase(path, config)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := db.storage.(*fileStorage)
+	start, end := fs.Bounds()
+	offset, defs := db.loadSnapshot(path, start, end)
+
+	f := &follower{stop: make(chan struct{}), done: make(chan struct{})}
+	if f.tail, err = fs.follow(offset); err == nil {
+		// Indexes are restored after the catch-up, so it doesn't update them record by record
+		err = f.tail.poll(db.follow)
+	}
+	if err != nil {
+		fs.Close()
+		return nil, err
+	}
+
+	db.restoreIndexes(defs)
+	db.follower = f
+
+	interval := config.FollowInterval
+	if interval <= 0 {
+		interval = DefaultFollowInterval
+	}
+	go db.followLog(f, interval)
+
+	return db, nil
+}
+
+// FollowErr returns the error that stopped following the log, nil while it is followed
+func (db *Database) FollowErr() error {
+	if db.follower == nil {
+		return nil
+	}
+
+	db.follower.mu.Lock()
+	defer db.follower.mu.Unlock()
+	return db.follower.err
+}
+
+func (db *Database) followLog(f *follower, interval time.Duration) {
+	defer close(f.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+
+		db.writeTx.Lock()
+		err := f.tail.poll(db.follow)
+		db.writeTx.Unlock()
+
+		if err != nil {
+			f.mu.Lock()
+			f.err = err
+			f.mu.Unlock()
+			return
+		}
+	}
+}
+
+// unfollow stops following the log
+func (db *Database) unfollow() {
+	if db.follower == nil {
+		return
+	}
+
+	close(db.follower.stop)
+	<-db.follower.done
+}
+
+// follow applies records of the followed log to the items and the indexes,
+// the caller must hold the write lock
+func (db *Database) follow(items []fileItem) error {
+	indexes := db.indexes.fork()
+
+	for i := range items {
+		item := &items[i]
+		if item.command == commandSET {
+			if err := db.compression.store(&item.item); err != nil {
+				return err
+			}
+		}
+
+		if dbItem := db.items.get(item.key); dbItem != nil {
+			dbItem.RLock()
+			current := dbItem.current
+			dbItem.RUnlock()
+
+			if current != nil {
+				indexes.Remove(current)
+			}
+		}
+
+		if item.command == commandSET {
+			indexes.Insert(&item.item)
+		}
+
+		db.items.apply(items[i : i+1])
+	}
+
+	db.setIndexes(indexes.merge())
+	return nil
+}
+
+// logTail reads records appended to the log by another process. It is positioned
+// after the last whole frame read and keeps the plaintext of an incomplete record.
+type logTail struct {
+	fs      *fileStorage
+	segment segment
+	file    *os.File
+	// pos is the position in the segment file after the last frame read
+	pos     int64
+	pending []byte
+	// applied is the log position after the last frame that ended with a whole record.
+	// Records after it can be applied already, replaying them again is harmless.
+	applied int64
+	// seen are the last bytes of the file read, from up to tailCheckSize before
+	// the last whole record to pos
+	seen []byte
+}
+
+// follow returns a tail of the log from the position offset
+func (fs *fileStorage) follow(offset int64) (*logTail, error) {
+	t := &logTail{fs: fs, applied: offset}
+
+	segments, err := t.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < segments[0].base {
+		return nil, ErrMissingSegment
+	}
+
+	for _, seg := range segments {
+		if seg.base <= offset {
+			t.segment = seg
+		}
+	}
+
+	if t.file, err = openSegment(t.segment); err != nil {
+		return nil, err
+	}
+	t.pos = offset - t.segment.base
+
+	fs.tail = t
+	return t, nil
+}
+
+// segments returns the segments listed by the writer
+func (t *logTail) segments() ([]segment, error) {
+	segments, err := readManifest(t.fs.path)
+	if segments == nil && err == nil {
+		segments = []segment{{id: 0, base: 0, path: t.fs.path}}
+	}
+
+	return segments, err
+}
+
+func openSegment(seg segment) (*os.File, error) {
+	file, err := os.Open(seg.path)
+	if os.IsNotExist(err) {
+		return nil, ErrMissingSegment
+	}
+
+	return file, err
+}
+
+// poll applies the records written since the last poll
+func (t *logTail) poll(apply func(items []fileItem) error) error {
+	for {
+		// The writer completes a segment before it lists the next one,
+		// so the segment is read to the end once the next one is listed
+		segments, err := t.segments()
+		if err != nil {
+			return err
+		}
+
+		var next *segment
+		for i := range segments {
+			if segments[i].id > t.segment.id {
+				next = &segments[i]
+				break
+			}
+		}
+
+		if err := t.read(apply); err != nil {
+			return err
+		}
+
+		if next == nil {
+			return nil
+		}
+
+		if len(t.pending) > 0 {
+			return ErrCorruptedLog
+		}
+
+		file, err := openSegment(*next)
+		if err != nil {
+			return err
+		}
+
+		t.file.Close()
+		t.file, t.segment, t.pos, t.applied, t.seen = file, *next, 0, next.base, nil
+	}
+}
+
+// read applies whole records of the frames appended to the segment
+func (t *logTail) read(apply func(items []fileItem) error) error {
+	if t.pos == 0 {
+		ok, err := t.readHeader()
+		if !ok || err != nil {
+			return err
+		}
+	}
+
+	if err := t.verify(); err != nil {
+		return err
+	}
+
+	for {
+		data, raw, err := t.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		t.pending = append(t.pending, data...)
+		t.seen = append(t.seen, raw...)
+
+		end := 0
+		for {
+			size, err := t.fs.format.scan(t.pending[end:])
+			if err != nil {
+				return err
+			}
+			if size == 0 {
+				break
+			}
+			end += size
+		}
+
+		if end > 0 {
+			items, err := t.fs.format.decode(t.pending[:end])
+			if err != nil {
+				return err
+			}
+
+			if err := apply(items); err != nil {
+				return err
+			}
+
+			t.pending = append([]byte{}, t.pending[end:]...)
+		}
+
+		if len(t.pending) == 0 {
+			t.applied = t.segment.base + t.pos
+		}
+
+		t.trimSeen()
+	}
+}
+
+// trimSeen keeps the bytes of the incomplete record and up to tailCheckSize before it
+func (t *logTail) trimSeen() {
+	keep := t.pos - t.lastRecord() + tailCheckSize
+	if int64(len(t.seen)) > keep {
+		t.seen = append([]byte{}, t.seen[int64(len(t.seen))-keep:]...)
+	}
+}
+
+// lastRecord returns the position in the segment file after the last whole record read.
+// Only whole frames are cut off an encrypted log, so that is the end of the last frame
+// that ended with a whole record there.
+func (t *logTail) lastRecord() int64 {
+	if t.fs.cipher != nil {
+		return t.applied - t.segment.base
+	}
+
+	return t.pos - int64(len(t.pending))
+}
+
+// verify checks that the bytes read last are still in the file. A writer cuts the log
+// at a whole record and writes new records after it, a follower holding a part of
+// a record cut off reads again from the last whole record then.
+func (t *logTail) verify() error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if len(t.seen) == 0 {
+		if info.Size() < t.pos {
+			return ErrLogCut
+		}
+		return nil
+	}
+
+	from := t.pos - int64(len(t.seen))
+	data := make([]byte, len(t.seen))
+	n, err := t.file.ReadAt(data, from)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if bytes.Equal(data[:n], t.seen) {
+		return nil
+	}
+
+	last := t.lastRecord()
+	kept := int(last - from)
+	if n < kept || !bytes.Equal(data[:kept], t.seen[:kept]) {
+		return ErrLogCut
+	}
+
+	t.pos, t.pending, t.seen = last, nil, t.seen[:kept]
+	return nil
+}
+
+// readHeader skips the encryption mark and the format mark, it returns false until
+// they are written
+func (t *logTail) readHeader() (bool, error) {
+	header := t.fs.header()
+	if header == "" {
+		return true, t.fs.checkHeader(t.file)
+	}
+
+	mark := make([]byte, len(header))
+	n, err := t.file.ReadAt(mark, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	if string(mark[:n]) != header[:n] {
+		if err := t.fs.cipher.checkEncryption(t.file); err != nil {
+			return false, err
+		}
+		return false, ErrFormatMismatch
+	}
+
+	if n < len(mark) {
+		return false, nil
+	}
+
+	t.pos = int64(n)
+	t.applied = t.segment.base + t.pos
+	return true, nil
+}
+
+// next returns the plaintext of the next frame of the segment or the data appended
+// to a plain one and the bytes read from the file, io.EOF if there is nothing new
+// or the next frame is incomplete
+func (t *logTail) next() ([]byte, []byte, error) {
+	r := io.NewSectionReader(t.file, t.pos, math.MaxInt64-t.pos)
+
+	if t.fs.cipher == nil {
+		buf := make([]byte, replayChunkSize)
+		n, err := r.Read(buf)
+		if n == 0 {
+			return nil, nil, err
+		}
+
+		t.pos += int64(n)
+		return buf[:n], buf[:n], nil
+	}
+
+	var raw bytes.Buffer
+	fr := &frameReader{cipher: t.fs.cipher, r: io.TeeReader(r, &raw), offset: t.pos}
+	if err := fr.next(); err != nil {
+		return nil, nil, err
+	}
+
+	t.pos += int64(raw.Len())
+	return fr.plain, raw.Bytes(), nil
+}
+
+func (t *logTail) close() error {
+	if t.file == nil {
+		return nil
+	}
+
+	return t.file.Close()
+}
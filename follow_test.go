@@ -0,0 +1,267 @@
+package memdb
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func followed(db *Database, key, expected string) func() bool {
+	return func() bool {
+		value, err := db.Begin(false).Get(key)
+		return err == nil && value == expected
+	}
+}
+
+func TestDatabase_Follow(t *testing.T) {
+	removeSegmented("follow.db")
+	defer removeSegmented("follow.db")
+
+	RegisterComparator("less", func(a, b string) bool {
+		return a < b
+	})
+
+	config := Config{Persist: true, SegmentSize: 256}
+	db, err := Open("follow.db", config)
+	require.Nil(t, err)
+
+	index, err := NewRegisteredIndex("values", "*", "less")
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(index))
+	require.Nil(t, tx.Set("a", "3"))
+	require.Nil(t, tx.Set("b", "1"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Snapshot("follow.db"+SnapshotSuffix))
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Set("c", "2"))
+	require.Nil(t, tx.Commit())
+
+	follower, err := Follow("follow.db", Config{FollowInterval: time.Millisecond})
+	require.Nil(t, err)
+	defer follower.Close()
+
+	ascend := func() []string {
+		keys := make([]string, 0)
+		require.Nil(t, follower.Begin(false).Ascend("values", func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		}))
+		return keys
+	}
+	assert.Equal(t, []string{"b", "c", "a"}, ascend())
+
+	// Commits of the writer reach the follower across segments
+	for i := 0; i < 30; i++ {
+		tx = db.Begin(true)
+		require.Nil(t, tx.Set("key"+strconv.Itoa(i), "value"))
+		require.Nil(t, tx.Commit())
+	}
+
+	tx = db.Begin(true)
+	_, err = tx.Update("a", "0")
+	require.Nil(t, err)
+	require.Nil(t, tx.Delete("c"))
+	require.Nil(t, tx.Commit())
+
+	require.Eventually(t, followed(follower, "a", "0"), time.Second, time.Millisecond)
+	assert.Equal(t, 32, countKeys(t, follower))
+	assert.Equal(t, []string{"a", "b", "key0"}, ascend()[:3])
+
+	tx = follower.Begin(true)
+	assert.Equal(t, ErrTxNotWritable, tx.Set("d", "value"))
+	require.Nil(t, tx.Rollback())
+
+	// Followers build local indexes
+	built, err := follower.BuildIndex(NewIndex("keys", "key*", func(a, b string) bool {
+		return a < b
+	}))
+	require.Nil(t, err)
+	<-built
+	n, err := follower.Begin(false).Len("keys")
+	require.Nil(t, err)
+	assert.Equal(t, 30, n)
+
+	// The follower keeps going after the writer compacts the segments it has read
+	require.Nil(t, db.Shrink())
+	tx = db.Begin(true)
+	require.Nil(t, tx.Set("d", "4"))
+	require.Nil(t, tx.Commit())
+
+	require.Eventually(t, followed(follower, "d", "4"), time.Second, time.Millisecond)
+	assert.Nil(t, follower.FollowErr())
+
+	require.Nil(t, db.Close())
+	require.Nil(t, follower.Close())
+}
+
+func TestDatabase_FollowEncrypted(t *testing.T) {
+	removeSegmented("follow.db")
+	defer removeSegmented("follow.db")
+
+	config := Config{Persist: true, EncryptionKey: bytes.Repeat([]byte{1}, 16)}
+	db, err := Open("follow.db", config)
+	require.Nil(t, err)
+
+	follower, err := Follow("follow.db", Config{EncryptionKey: config.EncryptionKey, FollowInterval: time.Millisecond})
+	require.Nil(t, err)
+	defer follower.Close()
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "secret value"))
+	require.Nil(t, tx.Commit())
+
+	require.Eventually(t, followed(follower, "1", "secret value"), time.Second, time.Millisecond)
+	require.Nil(t, db.Close())
+}
+
+func TestLogTail_IncompleteRecord(t *testing.T) {
+	removeSegmented("follow.db")
+	defer removeSegmented("follow.db")
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, item := range []fileItem{
+		{item: item{key: "1", value: "first"}, command: commandSET},
+		{item: item{key: "2", value: "second"}, command: commandSET},
+	} {
+		require.Nil(t, respFormat{}.encode(w, &item))
+	}
+	require.Nil(t, w.Flush())
+	data := buf.Bytes()
+
+	require.Nil(t, os.WriteFile("follow.db", data[:len(data)-3], 0666))
+
+	fs, err := openFileStorage("follow.db", fileOptions{readOnly: true})
+	require.Nil(t, err)
+	defer fs.Close()
+
+	tail, err := fs.follow(0)
+	require.Nil(t, err)
+
+	got := make([]dbKey, 0)
+	apply := func(items []fileItem) error {
+		for _, item := range items {
+			got = append(got, item.key)
+		}
+		return nil
+	}
+
+	require.Nil(t, tail.poll(apply))
+	assert.Equal(t, []dbKey{"1"}, got)
+
+	offset, err := fs.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), offset)
+
+	f, err := os.OpenFile("follow.db", os.O_APPEND|os.O_WRONLY, 0666)
+	require.Nil(t, err)
+	_, err = f.Write(data[len(data)-3:])
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	require.Nil(t, tail.poll(apply))
+	assert.Equal(t, []dbKey{"1", "2"}, got)
+
+	offset, err = fs.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(data)), offset)
+}
+
+func TestLogTail_WriterRestart(t *testing.T) {
+	for name, test := range map[string]struct {
+		config Config
+		size   int
+	}{
+		"plain":     {Config{Persist: true}, logBufferSize / 2},
+		"encrypted": {Config{Persist: true, EncryptionKey: bytes.Repeat([]byte{1}, 16)}, 3 * logBufferSize},
+	} {
+		config := test.config
+		t.Run(name, func(t *testing.T) {
+			removeSegmented("follow.db")
+			defer removeSegmented("follow.db")
+
+			db, err := Open("follow.db", config)
+			require.Nil(t, err)
+			tx := db.Begin(true)
+			require.Nil(t, tx.Set("a", "first"))
+			require.Nil(t, tx.Commit())
+
+			// The last commit of an encrypted log is larger than the write buffer, so a frame
+			// ends inside a record, and the writer crashes writing its end
+			tx = db.Begin(true)
+			require.Nil(t, tx.Set("b", strings.Repeat("b", test.size)))
+			require.Nil(t, tx.Commit())
+			require.Nil(t, db.Close())
+
+			info, err := os.Stat("follow.db")
+			require.Nil(t, err)
+			require.Nil(t, os.Truncate("follow.db", info.Size()-10))
+
+			cipher, err := newLogCipher(config)
+			require.Nil(t, err)
+			fs, err := openFileStorage("follow.db", fileOptions{readOnly: true, cipher: cipher})
+			require.Nil(t, err)
+			defer fs.Close()
+
+			tail, err := fs.follow(0)
+			require.Nil(t, err)
+			got := make(map[dbKey]string)
+			apply := func(items []fileItem) error {
+				for _, item := range items {
+					got[item.key] = item.value
+				}
+				return nil
+			}
+			require.Nil(t, tail.poll(apply))
+			assert.Equal(t, map[dbKey]string{"a": "first"}, got)
+
+			// The writer cuts the incomplete record and goes on
+			db, err = Open("follow.db", config)
+			require.Nil(t, err)
+			defer db.Close()
+			for _, key := range []string{"c", "d"} {
+				tx = db.Begin(true)
+				require.Nil(t, tx.Set(key, "value"))
+				require.Nil(t, tx.Commit())
+			}
+
+			require.Nil(t, tail.poll(apply))
+			assert.Equal(t, map[dbKey]string{"a": "first", "c": "value", "d": "value"}, got)
+		})
+	}
+}
+
+func TestLogTail_CutApplied(t *testing.T) {
+	removeSegmented("follow.db")
+	defer removeSegmented("follow.db")
+
+	fs, err := openFileStorage("follow.db", fileOptions{})
+	require.Nil(t, err)
+	require.Nil(t, fs.write(fileItem{item: item{key: "a", value: "first"}, command: commandSET}))
+	start := fs.activeSize
+	require.Nil(t, fs.write(fileItem{item: item{key: "b", value: "second"}, command: commandSET}))
+
+	follower, err := openFileStorage("follow.db", fileOptions{readOnly: true})
+	require.Nil(t, err)
+	defer follower.Close()
+	tail, err := follower.follow(0)
+	require.Nil(t, err)
+	require.Nil(t, tail.poll(func(items []fileItem) error { return nil }))
+
+	// A record applied by the follower is cut and other ones are written
+	require.Nil(t, fs.cut(start))
+	require.Nil(t, fs.write(fileItem{item: item{key: "c", value: "third"}, command: commandSET}))
+	require.Nil(t, fs.Close())
+
+	assert.Equal(t, ErrLogCut, tail.poll(func(items []fileItem) error { return nil }))
+}
@@ -0,0 +1,536 @@
+// Package httpapi serves a memdb database as a JSON API over HTTP.
+//
+//	GET    /keys?pattern=user:*&limit=10          NDJSON stream of items with matching keys
+//	GET    /keys/{key}                            the item of key
+//	PUT    /keys/{key}                            sets the value of {"value": "..."}
+//	DELETE /keys/{key}                            deletes key
+//	POST   /batch                                 runs operations in one transaction
+//	GET    /indexes                               stats of the indexes
+//	POST   /indexes                               creates {"name", "pattern", "comparator"}
+//	GET    /indexes/{name}                        stats of the index
+//	DELETE /indexes/{name}                        removes the index
+//	GET    /indexes/{name}/ascend?pivot=&limit=   NDJSON stream of items in index order
+//	GET    /indexes/{name}/descend?pivot=&limit=  the same in descending order
+//
+// Keys and index names are path escaped. Errors are returned as {"error": "..."}.
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/AplaProject/memdb"
+	"github.com/pkg/errors"
+)
+
+// flushEvery is the number of streamed items written between flushes to the client
+const flushEvery = 256
+
+// Limits of requests set by NewHandler
+const (
+	DefaultMaxBodySize = 32 << 20
+	DefaultMaxBatchOps = 10000
+)
+
+var (
+	ErrUnknownOp    = errors.New("unknown operation")
+	ErrInvalidBody  = errors.New("invalid request body")
+	ErrBodyTooLarge = errors.New("request body too large")
+	ErrTooManyOps   = errors.New("too many operations in batch")
+)
+
+// Item is a key with its value
+type Item struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// IndexDef describes an index to create, the comparator is registered with memdb.RegisterComparator
+type IndexDef struct {
+	Name       string `json:"name"`
+	Pattern    string `json:"pattern"`
+	Comparator string `json:"comparator"`
+}
+
+// IndexStats describes an index, see memdb.IndexStats
+type IndexStats struct {
+	Name       string `json:"name"`
+	Pattern    string `json:"pattern"`
+	Comparator string `json:"comparator,omitempty"`
+	Text       bool   `json:"text"`
+	Items      int    `json:"items"`
+	Memory     int    `json:"memory"`
+	Building   bool   `json:"building"`
+}
+
+func indexStats(s memdb.IndexStats) IndexStats {
+	return IndexStats{
+		Name:       s.Name,
+		Pattern:    s.Pattern,
+		Comparator: s.Comparator,
+		Text:       s.Text,
+		Items:      s.Items,
+		Memory:     s.Memory,
+		Building:   s.Building,
+	}
+}
+
+// Op is an operation of a batch: "get", "set" or "delete"
+type Op struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Batch is the body of POST /batch
+type Batch struct {
+	Ops []Op `json:"ops"`
+}
+
+// Result is the outcome of an operation of a batch. Found reports whether the key
+// existed before the operation, Value is the value read by get.
+type Result struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Found bool   `json:"found"`
+}
+
+// BatchResult is the response of POST /batch
+type BatchResult struct {
+	Results []Result `json:"results"`
+}
+
+// Error is the body of error responses. Op is the position of the operation
+// that failed a batch.
+type Error struct {
+	Error string `json:"error"`
+	Op    *int   `json:"op,omitempty"`
+}
+
+// Handler serves the API of a database
+type Handler struct {
+	// MaxBodySize limits the size of request bodies and MaxBatchOps the number of
+	// operations of a batch, larger requests are refused with 413. Zero doesn't limit.
+	// They are set before the handler serves requests.
+	MaxBodySize int64
+	MaxBatchOps int
+
+	db *memdb.Database
+}
+
+// NewHandler returns a handler of db with the default limits
+func NewHandler(db *memdb.Database) *Handler {
+	return &Handler{MaxBodySize: DefaultMaxBodySize, MaxBatchOps: DefaultMaxBatchOps, db: db}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+
+	switch {
+	case segments[0] == "keys" && len(segments) == 1:
+		h.route(w, r, map[string]http.HandlerFunc{http.MethodGet: h.listKeys})
+	case segments[0] == "keys":
+		// A key can contain unescaped slashes
+		key, err := url.PathUnescape(strings.Join(segments[1:], "/"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		h.route(w, r, map[string]http.HandlerFunc{
+			http.MethodGet:    func(w http.ResponseWriter, r *http.Request) { h.getKey(w, r, key) },
+			http.MethodPut:    func(w http.ResponseWriter, r *http.Request) { h.setKey(w, r, key) },
+			http.MethodDelete: func(w http.ResponseWriter, r *http.Request) { h.deleteKey(w, r, key) },
+		})
+	case segments[0] == "batch" && len(segments) == 1:
+		h.route(w, r, map[string]http.HandlerFunc{http.MethodPost: h.batch})
+	case segments[0] == "indexes" && len(segments) == 1:
+		h.route(w, r, map[string]http.HandlerFunc{
+			http.MethodGet:  h.listIndexes,
+			http.MethodPost: h.createIndex,
+		})
+	case segments[0] == "indexes" && len(segments) <= 3:
+		name, err := url.PathUnescape(segments[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if len(segments) == 2 {
+			h.route(w, r, map[string]http.HandlerFunc{
+				http.MethodGet:    func(w http.ResponseWriter, r *http.Request) { h.getIndex(w, r, name) },
+				http.MethodDelete: func(w http.ResponseWriter, r *http.Request) { h.dropIndex(w, r, name) },
+			})
+			return
+		}
+
+		switch segments[2] {
+		case "ascend", "descend":
+			descend := segments[2] == "descend"
+			h.route(w, r, map[string]http.HandlerFunc{
+				http.MethodGet: func(w http.ResponseWriter, r *http.Request) { h.scanIndex(w, r, name, descend) },
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) route(w http.ResponseWriter, r *http.Request, methods map[string]http.HandlerFunc) {
+	handler, ok := methods[r.Method]
+	if !ok {
+		allowed := make([]string, 0, len(methods))
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	handler(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, Error{Error: err.Error()})
+}
+
+// status returns the HTTP status of an error of the database
+func status(err error) int {
+	switch err {
+	case memdb.ErrNotFound, memdb.ErrUnknownIndex:
+		return http.StatusNotFound
+	case memdb.ErrAlreadyExists, memdb.ErrIndexExists:
+		return http.StatusConflict
+	case memdb.ErrTxNotWritable, memdb.ErrReadOnly:
+		return http.StatusForbidden
+	case memdb.ErrEmptyIndex, memdb.ErrUnknownComparator, memdb.ErrInvalidCursor, ErrUnknownOp, ErrInvalidBody:
+		return http.StatusBadRequest
+	case ErrBodyTooLarge, ErrTooManyOps:
+		return http.StatusRequestEntityTooLarge
+	case memdb.ErrIndexBuilding:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+// readJSON decodes the request body into v, reading at most MaxBodySize bytes
+func (h *Handler) readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body := r.Body
+	if h.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, body, h.MaxBodySize)
+	}
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return ErrBodyTooLarge
+		}
+		return ErrInvalidBody
+	}
+
+	return nil
+}
+
+// limit returns the limit query parameter, -1 if it is not set
+func limit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return -1, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid limit")
+	}
+
+	return n, nil
+}
+
+// stream writes items as NDJSON. The response is started before the first item,
+// so errors of the scan after it only end the stream.
+type stream struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	limit   int
+	written int
+}
+
+func newStream(w http.ResponseWriter, limit int) *stream {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	return &stream{w: w, enc: json.NewEncoder(w), limit: limit}
+}
+
+// write is the iterator of the scan, it stops the scan once the limit is reached
+// or the client has gone
+func (s *stream) write(key, value string) bool {
+	if err := s.enc.Encode(Item{Key: key, Value: value}); err != nil {
+		return false
+	}
+
+	s.written++
+	if flusher, ok := s.w.(http.Flusher); ok && s.written%flushEvery == 0 {
+		flusher.Flush()
+	}
+
+	return s.limit < 0 || s.written < s.limit
+}
+
+// run streams the items of scan or writes the error of a scan that failed before the first item
+func (s *stream) run(scan func(iterator func(key, value string) bool) error) {
+	if s.limit == 0 {
+		s.w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	err := scan(s.write)
+	if err != nil && s.written == 0 {
+		writeError(s.w, status(err), err)
+	}
+}
+
+func (h *Handler) listKeys(w http.ResponseWriter, r *http.Request) {
+	n, err := limit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	tx := h.db.Begin(false)
+	newStream(w, n).run(func(iterator func(key, value string) bool) error {
+		return tx.Keys(pattern, iterator)
+	})
+}
+
+func (h *Handler) getKey(w http.ResponseWriter, r *http.Request, key string) {
+	value, err := h.db.Begin(false).Get(key)
+	if err != nil {
+		writeError(w, status(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Item{Key: key, Value: value})
+}
+
+func (h *Handler) setKey(w http.ResponseWriter, r *http.Request, key string) {
+	var body struct {
+		Value *string `json:"value"`
+	}
+	if err := h.readJSON(w, r, &body); err != nil {
+		writeError(w, status(err), err)
+		return
+	}
+
+	if body.Value == nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidBody)
+		return
+	}
+
+	h.commit(w, []Op{{Op: "set", Key: key, Value: *body.Value}}, func(results []Result) {
+		status := http.StatusOK
+		if !results[0].Found {
+			status = http.StatusCreated
+		}
+
+		writeJSON(w, status, Item{Key: key, Value: *body.Value})
+	})
+}
+
+func (h *Handler) deleteKey(w http.ResponseWriter, r *http.Request, key string) {
+	h.commit(w, []Op{{Op: "delete", Key: key}}, func(results []Result) {
+		if !results[0].Found {
+			writeError(w, http.StatusNotFound, memdb.ErrNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	var batch Batch
+	if err := h.readJSON(w, r, &batch); err != nil {
+		writeError(w, status(err), err)
+		return
+	}
+
+	if h.MaxBatchOps > 0 && len(batch.Ops) > h.MaxBatchOps {
+		writeError(w, status(ErrTooManyOps), ErrTooManyOps)
+		return
+	}
+
+	h.commit(w, batch.Ops, func(results []Result) {
+		writeJSON(w, http.StatusOK, BatchResult{Results: results})
+	})
+}
+
+// commit runs ops in one transaction and calls done with their results after the commit.
+// Nothing is changed if an operation fails.
+func (h *Handler) commit(w http.ResponseWriter, ops []Op, done func(results []Result)) {
+	writable := false
+	for _, op := range ops {
+		writable = writable || op.Op != "get"
+	}
+
+	tx := h.db.Begin(writable)
+	results := make([]Result, 0, len(ops))
+	for i, op := range ops {
+		result, err := apply(tx, op)
+		if err != nil {
+			tx.Rollback()
+
+			i := i
+			writeJSON(w, status(err), Error{Error: err.Error(), Op: &i})
+			return
+		}
+
+		results = append(results, result)
+	}
+
+	if writable {
+		if err := tx.Commit(); err != nil {
+			writeError(w, status(err), err)
+			return
+		}
+	}
+
+	done(results)
+}
+
+func apply(tx *memdb.Transaction, op Op) (Result, error) {
+	result := Result{Key: op.Key}
+
+	var err error
+	switch op.Op {
+	case "get":
+		result.Value, err = tx.Get(op.Key)
+	case "set":
+		// Update replaces the value of an existing key, a new key is created with Set
+		if _, err = tx.Update(op.Key, op.Value); err == memdb.ErrNotFound {
+			return result, tx.Set(op.Key, op.Value)
+		}
+	case "delete":
+		err = tx.Delete(op.Key)
+	default:
+		return result, ErrUnknownOp
+	}
+
+	if err == memdb.ErrNotFound {
+		return result, nil
+	}
+
+	result.Found = err == nil
+	return result, err
+}
+
+func (h *Handler) listIndexes(w http.ResponseWriter, r *http.Request) {
+	stats := make([]IndexStats, 0)
+	for _, s := range h.db.Indexes() {
+		stats = append(stats, indexStats(s))
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (h *Handler) createIndex(w http.ResponseWriter, r *http.Request) {
+	var def IndexDef
+	if err := h.readJSON(w, r, &def); err != nil {
+		writeError(w, status(err), err)
+		return
+	}
+
+	index, err := memdb.NewRegisteredIndex(def.Name, def.Pattern, def.Comparator)
+	if err != nil {
+		writeError(w, status(err), err)
+		return
+	}
+
+	tx := h.db.Begin(true)
+	if err := tx.AddIndex(index); err != nil {
+		tx.Rollback()
+		writeError(w, status(err), err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, status(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, def)
+}
+
+func (h *Handler) getIndex(w http.ResponseWriter, r *http.Request, name string) {
+	stats, err := h.db.Begin(false).IndexStats(name)
+	if err != nil {
+		writeError(w, status(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, indexStats(stats))
+}
+
+func (h *Handler) dropIndex(w http.ResponseWriter, r *http.Request, name string) {
+	tx := h.db.Begin(true)
+
+	_, err := tx.IndexStats(name)
+	if err == nil {
+		err = tx.RemoveIndex(name)
+	}
+	if err != nil {
+		tx.Rollback()
+		writeError(w, status(err), err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, status(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) scanIndex(w http.ResponseWriter, r *http.Request, name string, descend bool) {
+	n, err := limit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := r.URL.Query()
+	_, hasPivot := query["pivot"]
+	pivot := query.Get("pivot")
+
+	tx := h.db.Begin(false)
+	newStream(w, n).run(func(iterator func(key, value string) bool) error {
+		switch {
+		case descend && hasPivot:
+			return tx.DescendLessOrEqual(name, pivot, iterator)
+		case descend:
+			return tx.Descend(name, iterator)
+		case hasPivot:
+			return tx.AscendGreaterOrEqual(name, pivot, iterator)
+		}
+
+		return tx.Ascend(name, iterator)
+	})
+}
@@ -0,0 +1,226 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AplaProject/memdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	memdb.RegisterComparator("numeric", func(a, b string) bool {
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		return x < y
+	})
+}
+
+func request(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), v), w.Body.String())
+}
+
+func lines(t *testing.T, w *httptest.ResponseRecorder) []Item {
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+	items := make([]Item, 0)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var item Item
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &item))
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func newTestHandler(t *testing.T) (*Handler, *memdb.Database) {
+	db, err := memdb.OpenDB("", false)
+	require.Nil(t, err)
+
+	return NewHandler(db), db
+}
+
+func TestHandler_Keys(t *testing.T) {
+	h, db := newTestHandler(t)
+	defer db.Close()
+
+	w := request(t, h, http.MethodPut, "/keys/user:1", `{"value": "alice"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(t, h, http.MethodPut, "/keys/user:1", `{"value": "bob"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(t, h, http.MethodPut, "/keys/a%2Fb", `{"value": "slash"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusBadRequest, request(t, h, http.MethodPut, "/keys/user:2", `{}`).Code)
+
+	var item Item
+	w = request(t, h, http.MethodGet, "/keys/user:1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	decode(t, w, &item)
+	assert.Equal(t, Item{Key: "user:1", Value: "bob"}, item)
+
+	w = request(t, h, http.MethodGet, "/keys/a/b", "")
+	decode(t, w, &item)
+	assert.Equal(t, Item{Key: "a/b", Value: "slash"}, item)
+
+	var e Error
+	w = request(t, h, http.MethodGet, "/keys/missing", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	decode(t, w, &e)
+	assert.Equal(t, memdb.ErrNotFound.Error(), e.Error)
+
+	for i := 0; i < 10; i++ {
+		request(t, h, http.MethodPut, "/keys/item:"+strconv.Itoa(i), `{"value": "v"}`)
+	}
+
+	w = request(t, h, http.MethodGet, "/keys?pattern=item:*&limit=3", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []Item{{"item:0", "v"}, {"item:1", "v"}, {"item:2", "v"}}, lines(t, w))
+	assert.Len(t, lines(t, request(t, h, http.MethodGet, "/keys", "")), 12)
+
+	assert.Equal(t, http.StatusNoContent, request(t, h, http.MethodDelete, "/keys/user:1", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(t, h, http.MethodDelete, "/keys/user:1", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, request(t, h, http.MethodPost, "/keys/user:1", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(t, h, http.MethodGet, "/unknown", "").Code)
+}
+
+func TestHandler_Batch(t *testing.T) {
+	h, db := newTestHandler(t)
+	defer db.Close()
+
+	request(t, h, http.MethodPut, "/keys/1", `{"value": "first"}`)
+
+	w := request(t, h, http.MethodPost, "/batch", `{"ops": [
+		{"op": "set", "key": "2", "value": "second"},
+		{"op": "get", "key": "2"},
+		{"op": "delete", "key": "1"},
+		{"op": "get", "key": "1"},
+		{"op": "set", "key": "2", "value": "updated"}
+	]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var result BatchResult
+	decode(t, w, &result)
+	assert.Equal(t, []Result{
+		{Key: "2"},
+		{Key: "2", Value: "second", Found: true},
+		{Key: "1", Found: true},
+		{Key: "1"},
+		{Key: "2", Found: true},
+	}, result.Results)
+
+	// A failed operation rolls back the batch
+	w = request(t, h, http.MethodPost, "/batch", `{"ops": [
+		{"op": "set", "key": "3", "value": "third"},
+		{"op": "rename", "key": "2"}
+	]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var e Error
+	decode(t, w, &e)
+	require.NotNil(t, e.Op)
+	assert.Equal(t, 1, *e.Op)
+	assert.Equal(t, http.StatusNotFound, request(t, h, http.MethodGet, "/keys/3", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(t, h, http.MethodPost, "/batch", `{"ops":`).Code)
+
+	// Large requests are refused before they run
+	h.MaxBodySize, h.MaxBatchOps = 64, 2
+	w = request(t, h, http.MethodPut, "/keys/4", `{"value": "`+strings.Repeat("v", 64)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	decode(t, w, &e)
+	assert.Equal(t, ErrBodyTooLarge.Error(), e.Error)
+
+	w = request(t, h, http.MethodPost, "/batch", `{"ops": [{"op": "get", "key": "1"}, {"op": "get", "key": "2"}, {"op": "get", "key": "3"}]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	h.MaxBodySize = 0
+	w = request(t, h, http.MethodPost, "/batch", `{"ops": [{"op": "set", "key": "4", "value": "fourth"}, {"op": "get", "key": "2"}, {"op": "get", "key": "3"}]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	decode(t, w, &e)
+	assert.Equal(t, ErrTooManyOps.Error(), e.Error)
+	assert.Equal(t, http.StatusNotFound, request(t, h, http.MethodGet, "/keys/4", "").Code)
+}
+
+func TestHandler_Indexes(t *testing.T) {
+	h, db := newTestHandler(t)
+	defer db.Close()
+
+	for key, age := range map[string]string{"a": "30", "b": "9", "c": "30", "d": "100"} {
+		request(t, h, http.MethodPut, "/keys/user:"+key, `{"value": "`+age+`"}`)
+	}
+
+	w := request(t, h, http.MethodPost, "/indexes", `{"name": "ages", "pattern": "user:*", "comparator": "numeric"}`)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = request(t, h, http.MethodPost, "/indexes", `{"name": "ages", "pattern": "user:*", "comparator": "numeric"}`)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = request(t, h, http.MethodPost, "/indexes", `{"name": "ages", "pattern": "*", "comparator": "numeric"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = request(t, h, http.MethodPost, "/indexes", `{"name": "other", "pattern": "*", "comparator": "unknown"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var stats IndexStats
+	decode(t, request(t, h, http.MethodGet, "/indexes/ages", ""), &stats)
+	assert.Equal(t, "numeric", stats.Comparator)
+	assert.Equal(t, 4, stats.Items)
+
+	var all []IndexStats
+	decode(t, request(t, h, http.MethodGet, "/indexes", ""), &all)
+	assert.Len(t, all, 1)
+
+	assert.Equal(t, []Item{{"user:b", "9"}, {"user:a", "30"}, {"user:c", "30"}, {"user:d", "100"}},
+		lines(t, request(t, h, http.MethodGet, "/indexes/ages/ascend", "")))
+	assert.Equal(t, []Item{{"user:a", "30"}, {"user:c", "30"}},
+		lines(t, request(t, h, http.MethodGet, "/indexes/ages/ascend?pivot=30&limit=2", "")))
+	assert.Equal(t, []Item{{"user:c", "30"}, {"user:a", "30"}, {"user:b", "9"}},
+		lines(t, request(t, h, http.MethodGet, "/indexes/ages/descend?pivot=50", "")))
+	assert.Equal(t, []Item{{"user:d", "100"}},
+		lines(t, request(t, h, http.MethodGet, "/indexes/ages/descend?limit=1", "")))
+
+	// An updated value replaces the entry of the key
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodPut, "/keys/user:b", `{"value": "200"}`).Code)
+	assert.Equal(t, []Item{{"user:a", "30"}, {"user:c", "30"}, {"user:d", "100"}, {"user:b", "200"}},
+		lines(t, request(t, h, http.MethodGet, "/indexes/ages/ascend", "")))
+
+	assert.Equal(t, http.StatusNotFound, request(t, h, http.MethodGet, "/indexes/unknown/ascend", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(t, h, http.MethodGet, "/indexes/ages/ascend?limit=x", "").Code)
+
+	assert.Equal(t, http.StatusNoContent, request(t, h, http.MethodDelete, "/indexes/ages", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(t, h, http.MethodDelete, "/indexes/ages", "").Code)
+}
+
+func TestHandler_Stream(t *testing.T) {
+	h, db := newTestHandler(t)
+	defer db.Close()
+
+	tx := db.Begin(true)
+	for i := 0; i < 1000; i++ {
+		require.Nil(t, tx.Set("key:"+strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	require.Nil(t, tx.Commit())
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/keys?pattern=key:*")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		count++
+	}
+	require.Nil(t, scanner.Err())
+	assert.Equal(t, 1000, count)
+}
@@ -2,6 +2,11 @@ package memdb
 
 import (
 	"errors"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"unsafe"
 
 	"github.com/tidwall/btree"
 	"github.com/tidwall/match"
@@ -9,28 +14,72 @@ import (
 
 const btreeDegrees = 64
 
+// btreeEntrySize is the approximate size of one btree entry, an interface value
+// in a node that is on average three quarters full
+const btreeEntrySize = int(unsafe.Sizeof(btree.Item(nil))) * 4 / 3
+
 var (
-	ErrEmptyIndex   = errors.New("index name is empty")
-	ErrIndexExists  = errors.New("index already exists")
-	ErrUnknownIndex = errors.New("unknown index")
+	ErrEmptyIndex    = errors.New("index name is empty")
+	ErrIndexExists   = errors.New("index already exists")
+	ErrUnknownIndex  = errors.New("unknown index")
+	ErrIndexBuilding = errors.New("index is building")
+
+	ErrUnknownComparator = errors.New("unknown comparator")
 )
 
+var comparators = struct {
+	sync.RWMutex
+	storage map[string]func(a, b string) bool
+}{storage: make(map[string]func(a, b string) bool)}
+
+// RegisterComparator makes sortFn available by name for NewRegisteredIndex and for
+// restoring index definitions from snapshots
+func RegisterComparator(name string, sortFn func(a, b string) bool) {
+	comparators.Lock()
+	comparators.storage[name] = sortFn
+	comparators.Unlock()
+}
+
+func getComparator(name string) func(a, b string) bool {
+	comparators.RLock()
+	defer comparators.RUnlock()
+	return comparators.storage[name]
+}
+
 type Index struct {
 	name    string
 	pattern string
-	tree    *btree.BTree
+	tree    *rankTree
 	sortFn  func(a, b string) bool
+	// comparator is the name of sortFn
+	comparator string
+
+	// building is set while the index is populated in background
+	building *indexBuild
 }
 
 func NewIndex(name, pattern string, sortFn func(a, b string) bool) *Index {
 	i := new(Index)
-	i.tree = btree.New(btreeDegrees, i)
+	i.tree = newRankTree(btreeDegrees, i)
 	i.pattern = pattern
 	i.name = name
 	i.sortFn = sortFn
+	i.comparator = funcName(sortFn)
 	return i
 }
 
+// NewRegisteredIndex creates an index sorted by a comparator registered with RegisterComparator
+func NewRegisteredIndex(name, pattern, comparator string) (*Index, error) {
+	sortFn := getComparator(comparator)
+	if sortFn == nil {
+		return nil, ErrUnknownComparator
+	}
+
+	i := NewIndex(name, pattern, sortFn)
+	i.comparator = comparator
+	return i, nil
+}
+
 func (idx *Index) insert(item btree.Item) {
 	idx.tree.ReplaceOrInsert(item)
 }
@@ -39,23 +88,120 @@ func (idx *Index) remove(item btree.Item) {
 	idx.tree.Delete(item)
 }
 
+// IndexStats describes an index. Memory is an approximate size of the index structures,
+// values are shared with the database and are not counted.
+type IndexStats struct {
+	Name       string
+	Pattern    string
+	Comparator string
+	Text       bool
+	Items      int
+	Memory     int
+	Building   bool
+}
+
+func (idx *Index) stats() IndexStats {
+	return IndexStats{
+		Name:       idx.name,
+		Pattern:    idx.pattern,
+		Comparator: idx.comparator,
+		Items:      idx.tree.Len(),
+		Memory:     idx.tree.Len() * btreeEntrySize,
+		Building:   idx.building != nil,
+	}
+}
+
+func funcName(fn interface{}) string {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return ""
+	}
+
+	f := runtime.FuncForPC(v.Pointer())
+	if f == nil {
+		return ""
+	}
+
+	return f.Name()
+}
+
+func (idx *Index) clone() *Index {
+	return &Index{
+		name:       idx.name,
+		pattern:    idx.pattern,
+		sortFn:     idx.sortFn,
+		comparator: idx.comparator,
+		tree:       idx.tree.Clone(),
+		building:   idx.building,
+	}
+}
+
 // Indexes is not thread-safe
 type Indexes struct {
 	storage map[string]*Index
+	text    map[string]*TextIndex
+
+	// base is shared with the committed state, its indexes are cloned into
+	// storage on first write. removed hides base indexes dropped by the fork.
+	base    *Indexes
+	removed map[string]struct{}
 }
 
 func newIndexer() *Indexes {
 	return &Indexes{
 		storage: make(map[string]*Index),
+		text:    make(map[string]*TextIndex),
 	}
 }
 
+// fork returns indexes that read through to idxer and clone an index only when it is modified
+func (idxer *Indexes) fork() *Indexes {
+	forked := newIndexer()
+	forked.base = idxer
+	forked.removed = make(map[string]struct{})
+	return forked
+}
+
+// merge returns committed indexes, which are the base with modified roots swapped in
+func (idxer *Indexes) merge() *Indexes {
+	if idxer.base == nil {
+		return idxer
+	}
+
+	if len(idxer.storage) == 0 && len(idxer.text) == 0 && len(idxer.removed) == 0 {
+		return idxer.base
+	}
+
+	merged := newIndexer()
+	for name, index := range idxer.base.storage {
+		if _, ok := idxer.removed[name]; !ok {
+			merged.storage[name] = index
+		}
+	}
+
+	for name, index := range idxer.base.text {
+		if _, ok := idxer.removed[name]; !ok {
+			merged.text[name] = index
+		}
+	}
+
+	for name, index := range idxer.storage {
+		merged.storage[name] = index
+	}
+
+	for name, index := range idxer.text {
+		merged.text[name] = index
+	}
+
+	return merged
+}
+
 func (idxer *Indexes) AddIndex(index *Index) error {
 	if index.name == "" {
 		return ErrEmptyIndex
 	}
 
-	if _, ok := idxer.storage[index.name]; ok {
+	if idxer.Has(index.name) {
 		return ErrIndexExists
 	}
 
@@ -64,47 +210,150 @@ func (idxer *Indexes) AddIndex(index *Index) error {
 	return nil
 }
 
+func (idxer *Indexes) AddTextIndex(index *TextIndex) error {
+	if index.name == "" {
+		return ErrEmptyIndex
+	}
+
+	if idxer.Has(index.name) {
+		return ErrIndexExists
+	}
+
+	idxer.text[index.name] = index
+
+	return nil
+}
+
 func (idxer *Indexes) RemoveIndex(name string) error {
 	if name == "" {
 		return ErrEmptyIndex
 	}
 
 	delete(idxer.storage, name)
+	delete(idxer.text, name)
+
+	if idxer.base != nil && idxer.base.Has(name) {
+		idxer.removed[name] = struct{}{}
+	}
 
 	return nil
 }
 
 func (idxer *Indexes) GetIndex(name string) *Index {
-	for indexName, index := range idxer.storage {
-		if name == indexName {
-			return index
-		}
+	if index, ok := idxer.storage[name]; ok {
+		return index
+	}
+
+	if idxer.inherits(name) {
+		return idxer.base.GetIndex(name)
+	}
+
+	return nil
+}
+
+func (idxer *Indexes) GetTextIndex(name string) *TextIndex {
+	if index, ok := idxer.text[name]; ok {
+		return index
+	}
+
+	if idxer.inherits(name) {
+		return idxer.base.GetTextIndex(name)
 	}
 
 	return nil
 }
 
 func (idxer *Indexes) Has(name string) bool {
-	return idxer.GetIndex(name) != nil
+	return idxer.GetIndex(name) != nil || idxer.GetTextIndex(name) != nil
+}
+
+// inherits reports whether name is resolved by the base indexes
+func (idxer *Indexes) inherits(name string) bool {
+	if idxer.base == nil {
+		return false
+	}
+
+	if _, ok := idxer.removed[name]; ok {
+		return false
+	}
+
+	_, ok := idxer.storage[name]
+	_, textOk := idxer.text[name]
+	return !ok && !textOk
 }
 
 // TODO rename to ReplaceOrInsert
 func (idxer *Indexes) Insert(item *item, to ...string) {
-	for _, index := range idxer.storage {
-		if idxer.fit(index.name, to) && match.Match(string(item.key), index.pattern) {
-			index.insert(item)
-		}
-	}
+	idxer.each(item.key, to, func(index *Index) {
+		index.insert(item)
+	}, func(index *TextIndex) {
+		index.insert(item)
+	})
 }
 
 func (idxer *Indexes) Remove(item *item, from ...string) {
+	idxer.each(item.key, from, func(index *Index) {
+		index.remove(item)
+	}, func(index *TextIndex) {
+		index.remove(item.key)
+	})
+}
+
+// each calls fn for every index that covers key, cloning base indexes before they are modified
+func (idxer *Indexes) each(key dbKey, names []string, fn func(*Index), textFn func(*TextIndex)) {
 	for _, index := range idxer.storage {
-		if idxer.fit(index.name, from) && match.Match(string(item.key), index.pattern) {
-			index.remove(item)
+		if idxer.fit(index.name, names) && match.Match(string(key), index.pattern) {
+			fn(index)
+		}
+	}
+
+	for _, index := range idxer.text {
+		if idxer.fit(index.name, names) && match.Match(string(key), index.pattern) {
+			textFn(index)
+		}
+	}
+
+	if idxer.base == nil {
+		return
+	}
+
+	for name, index := range idxer.base.storage {
+		if idxer.inherits(name) && idxer.fit(name, names) && match.Match(string(key), index.pattern) {
+			index = index.clone()
+			idxer.storage[name] = index
+			fn(index)
+		}
+	}
+
+	for name, index := range idxer.base.text {
+		if idxer.inherits(name) && idxer.fit(name, names) && match.Match(string(key), index.pattern) {
+			index = index.clone()
+			idxer.text[name] = index
+			textFn(index)
 		}
 	}
 }
 
+// Stats returns stats of every index ordered by name
+func (idxer *Indexes) Stats() []IndexStats {
+	merged := idxer.merge()
+	stats := make([]IndexStats, 0, len(merged.storage)+len(merged.text))
+
+	for _, index := range merged.storage {
+		stats = append(stats, index.stats())
+	}
+
+	for _, index := range merged.text {
+		stats = append(stats, index.stats())
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+
+	return stats
+}
+
 func (idxer *Indexes) fit(current string, indexes []string) bool {
 	if len(indexes) == 0 {
 		return true
@@ -121,12 +370,17 @@ func (idxer *Indexes) fit(current string, indexes []string) bool {
 
 func (idxer *Indexes) Copy() *Indexes {
 	newIndexer := newIndexer()
+	merged := idxer.merge()
 
-	for _, oldIdx := range idxer.storage {
-		newIdx := &Index{name: oldIdx.name, pattern: oldIdx.pattern, sortFn: oldIdx.sortFn}
-		newIdx.tree = oldIdx.tree.Clone()
+	for _, oldIdx := range merged.storage {
+		err := newIndexer.AddIndex(oldIdx.clone())
+		if err != nil {
+			panic(err)
+		}
+	}
 
-		err := newIndexer.AddIndex(newIdx)
+	for _, oldIdx := range merged.text {
+		err := newIndexer.AddTextIndex(oldIdx.clone())
 		if err != nil {
 			panic(err)
 		}
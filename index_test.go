@@ -130,3 +130,65 @@ func TestIndex_MultipleIndex(t *testing.T) {
 		cases[4], cases[2], cases[3], cases[0], cases[5], cases[1],
 	}, got)
 }
+
+func TestIndex_Fork(t *testing.T) {
+	indexer := newIndexer()
+	lengthIdx := NewIndex("test-length", "*.test", func(a, b string) bool {
+		return len(a) < len(b)
+	})
+	otherIdx := NewIndex("other", "*.other", func(a, b string) bool {
+		return a < b
+	})
+	require.Nil(t, indexer.AddIndex(lengthIdx))
+	require.Nil(t, indexer.AddIndex(otherIdx))
+	indexer.Insert(&item{key: "1.test", value: "first"})
+
+	forked := indexer.fork()
+	assert.True(t, forked.GetIndex("test-length") == lengthIdx)
+
+	forked.Insert(&item{key: "2.test", value: "sec"})
+	assert.False(t, forked.GetIndex("test-length") == lengthIdx)
+	assert.True(t, forked.GetIndex("other") == otherIdx)
+	assert.Equal(t, 1, lengthIdx.tree.Len())
+	assert.Equal(t, 2, forked.GetIndex("test-length").tree.Len())
+
+	require.Nil(t, forked.RemoveIndex("other"))
+	assert.False(t, forked.Has("other"))
+	assert.True(t, indexer.Has("other"))
+
+	merged := forked.merge()
+	assert.Equal(t, 2, merged.GetIndex("test-length").tree.Len())
+	assert.Nil(t, merged.GetIndex("other"))
+	assert.Equal(t, 1, indexer.GetIndex("test-length").tree.Len())
+
+	assert.True(t, indexer.fork().merge() == indexer)
+}
+
+func lengthLess(a, b string) bool {
+	return len(a) < len(b)
+}
+
+func TestIndexes_Stats(t *testing.T) {
+	indexer := newIndexer()
+	require.Nil(t, indexer.AddIndex(NewIndex("test-length", "*.test", lengthLess)))
+	require.Nil(t, indexer.AddTextIndex(NewTextIndex("a-text", "*")))
+
+	indexer.Insert(&item{key: "1.test", value: "first value"})
+	indexer.Insert(&item{key: "2.test", value: "second"})
+	indexer.Insert(&item{key: "other", value: "other"})
+
+	stats := indexer.Stats()
+	require.Len(t, stats, 2)
+
+	assert.Equal(t, "a-text", stats[0].Name)
+	assert.True(t, stats[0].Text)
+	assert.Equal(t, 3, stats[0].Items)
+	assert.True(t, stats[0].Memory > 0)
+
+	assert.Equal(t, "test-length", stats[1].Name)
+	assert.Equal(t, "*.test", stats[1].Pattern)
+	assert.Equal(t, "github.com/AplaProject/memdb.lengthLess", stats[1].Comparator)
+	assert.Equal(t, 2, stats[1].Items)
+	assert.True(t, stats[1].Memory > 0)
+	assert.False(t, stats[1].Building)
+}
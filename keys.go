@@ -0,0 +1,123 @@
+package memdb
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tidwall/match"
+)
+
+const (
+	// keysBatch is the number of keys taken from the keyspace under one lock
+	keysBatch = 256
+
+	defaultScanCount = 10
+)
+
+var ErrInvalidCursor = errors.New("invalid scan cursor")
+
+// Keys iterates in key order over the keys matching the glob pattern
+func (tx *Transaction) Keys(pattern string, iterator func(key, value string) bool) error {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	prefix := globPrefix(pattern)
+	from, inclusive := dbKey(prefix), true
+
+	for {
+		keys := tx.db.items.ascend(from, inclusive, keysBatch)
+		if len(keys) == 0 {
+			return nil
+		}
+
+		for _, key := range keys {
+			if !strings.HasPrefix(string(key), prefix) {
+				return nil
+			}
+
+			if !match.Match(string(key), pattern) {
+				continue
+			}
+
+			revision, err := tx.getKey(key)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if !revision.visit(iterator, &err) {
+				return err
+			}
+		}
+
+		from, inclusive = keys[len(keys)-1], false
+	}
+}
+
+// Scan examines at most count keys after cursor and returns those matching the glob pattern.
+// The scan starts with an empty cursor and is complete when the returned cursor is empty.
+func (tx *Transaction) Scan(pattern, cursor string, count int) (string, []string, error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	if tx.db == nil {
+		return "", nil, ErrTxClosed
+	}
+
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	prefix := globPrefix(pattern)
+	from, inclusive := dbKey(prefix), true
+	if cursor != "" {
+		last, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return "", nil, ErrInvalidCursor
+		}
+
+		from, inclusive = dbKey(last), false
+	}
+
+	found := make([]string, 0)
+	keys := tx.db.items.ascend(from, inclusive, count)
+	for _, key := range keys {
+		if !strings.HasPrefix(string(key), prefix) {
+			return "", found, nil
+		}
+
+		if !match.Match(string(key), pattern) {
+			continue
+		}
+
+		if _, err := tx.getKey(key); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		found = append(found, string(key))
+	}
+
+	if len(keys) < count {
+		return "", found, nil
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1])), found, nil
+}
+
+// globPrefix returns the literal part of pattern before the first wildcard
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+
+	return pattern
+}
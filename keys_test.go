@@ -0,0 +1,75 @@
+package memdb
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction_Keys(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("user:2", "b"))
+	require.Nil(t, tx.Set("user:1", "a"))
+	require.Nil(t, tx.Set("user:10", "c"))
+	require.Nil(t, tx.Set("order:1", "d"))
+	require.Nil(t, tx.Commit())
+
+	keys := func(tx *Transaction, pattern string) []string {
+		got := make([]string, 0)
+		require.Nil(t, tx.Keys(pattern, func(key, value string) bool {
+			got = append(got, key+"="+value)
+			return true
+		}))
+		return got
+	}
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Delete("user:2"))
+	require.Nil(t, tx.Set("user:3", "e"))
+
+	read := db.Begin(false)
+	assert.Equal(t, []string{"user:1=a", "user:10=c", "user:2=b"}, keys(read, "user:*"))
+	assert.Equal(t, []string{"user:1=a", "user:10=c", "user:3=e"}, keys(tx, "user:*"))
+	assert.Equal(t, []string{"order:1=d", "user:1=a"}, keys(read, "*:1"))
+	assert.Equal(t, []string{"user:1=a", "user:2=b"}, keys(read, "user:?"))
+	assert.Equal(t, []string{"order:1=d"}, keys(read, "order:1"))
+}
+
+func TestTransaction_Scan(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	for i := 0; i < 1000; i++ {
+		require.Nil(t, tx.Set("key:"+strconv.Itoa(i), "value"))
+		require.Nil(t, tx.Set("other:"+strconv.Itoa(i), "value"))
+	}
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	seen := make(map[string]struct{})
+	cursor := ""
+	calls := 0
+	for {
+		next, keys, err := tx.Scan("key:*5", cursor, 100)
+		require.Nil(t, err)
+		for _, key := range keys {
+			seen[key] = struct{}{}
+		}
+
+		calls++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	assert.Len(t, seen, 100)
+	assert.Equal(t, 11, calls)
+
+	_, _, err := tx.Scan("*", "%%%", 10)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package memdb
+
+import "os"
+
+// lockFile fails, a writable log can't be locked against other writers on this platform
+func lockFile(path string) (*os.File, error) {
+	return nil, ErrLockUnsupported
+}
@@ -0,0 +1,43 @@
+//go:build windows
+// +build windows
+
+package memdb
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFile takes an exclusive lock on the log file at path, creating it if needed.
+// The lock is released when the returned file is closed or the process exits.
+// Windows locks are mandatory, so the byte locked lies far past the end of the log
+// and readers of the file are not blocked.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	overlapped := syscall.Overlapped{Offset: 0xffffffff, OffsetHigh: 0x7fffffff}
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately,
+		0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		f.Close()
+		if err == errorLockViolation {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
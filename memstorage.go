@@ -0,0 +1,107 @@
+package memdb
+
+import "sync"
+
+// MemoryStorage keeps the log in memory. It lets tests run a database with persistence
+// and inspect the records it writes. Positions in the log are record numbers.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	records []Record
+	// base is the position of the first kept record
+	base  int64
+	stats LogStats
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{records: make([]Record, 0)}
+}
+
+// Records returns the kept records of the log
+func (ms *MemoryStorage) Records() []Record {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return append([]Record{}, ms.records...)
+}
+
+func (ms *MemoryStorage) Append(records []Record) func() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.records = append(ms.records, records...)
+	ms.stats.Commits++
+	ms.stats.Records += int64(len(records))
+	for _, r := range records {
+		ms.stats.PayloadBytes += int64(len(r.Key) + len(r.Value))
+	}
+
+	return func() error { return nil }
+}
+
+func (ms *MemoryStorage) Sync() (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.base + int64(len(ms.records)), nil
+}
+
+func (ms *MemoryStorage) Snapshot() (int64, error) {
+	return ms.Sync()
+}
+
+func (ms *MemoryStorage) Replay(offset int64, apply func(records []Record) error) error {
+	ms.mu.Lock()
+	if offset < ms.base {
+		ms.mu.Unlock()
+		return ErrMissingSegment
+	}
+
+	records := make([]Record, 0)
+	if offset-ms.base < int64(len(ms.records)) {
+		records = append(records, ms.records[offset-ms.base:]...)
+	}
+	ms.mu.Unlock()
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	return apply(records)
+}
+
+func (ms *MemoryStorage) Bounds() (int64, int64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.base, ms.base + int64(len(ms.records))
+}
+
+func (ms *MemoryStorage) Compact(offset int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if offset <= ms.base {
+		return nil
+	}
+
+	drop := offset - ms.base
+	if drop > int64(len(ms.records)) {
+		drop = int64(len(ms.records))
+	}
+
+	ms.records = append([]Record{}, ms.records[drop:]...)
+	ms.base += drop
+	return nil
+}
+
+func (ms *MemoryStorage) Stats() LogStats {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.stats
+}
+
+// Close keeps the records, so a database can be opened with the storage again
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,204 @@
+package memdb
+
+import (
+	"github.com/tidwall/btree"
+)
+
+// Count returns the number of items of index with values in [from, to).
+// Values are compared with the index comparator, the count is found by rank lookups.
+func (tx *Transaction) Count(index, from, to string) (int, error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	i, err := tx.index(index)
+	if err != nil {
+		return 0, err
+	}
+
+	count := i.tree.Rank(&item{value: to}) - i.tree.Rank(&item{value: from})
+	if count < 0 {
+		return 0, nil
+	}
+
+	return count, nil
+}
+
+// Min returns the first item of index or ErrNotFound if the index is empty
+func (tx *Transaction) Min(index string) (key, value string, err error) {
+	return tx.edge(index, func(tree *rankTree) btree.Item {
+		return tree.Min()
+	})
+}
+
+// Max returns the last item of index or ErrNotFound if the index is empty
+func (tx *Transaction) Max(index string) (key, value string, err error) {
+	return tx.edge(index, func(tree *rankTree) btree.Item {
+		return tree.Max()
+	})
+}
+
+func (tx *Transaction) edge(index string, get func(tree *rankTree) btree.Item) (string, string, error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	i, err := tx.index(index)
+	if err != nil {
+		return "", "", err
+	}
+
+	found := get(i.tree)
+	if found == nil {
+		return "", "", ErrNotFound
+	}
+
+	item := found.(*item)
+	value, err := item.plain()
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(item.key), value, nil
+}
+
+// AscendGreaterOrEqual iterates over items of index with values greater than or equal to pivot
+func (tx *Transaction) AscendGreaterOrEqual(index, pivot string, iterator func(key, value string) bool) error {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	i, err := tx.index(index)
+	if err != nil {
+		return err
+	}
+
+	i.tree.AscendGreaterOrEqual(&item{value: pivot}, func(bitem btree.Item) bool {
+		curitem := bitem.(*item)
+		return curitem.visit(iterator, &err)
+	})
+
+	return err
+}
+
+// Descend iterates over items of index in descending order
+func (tx *Transaction) Descend(index string, iterator func(key, value string) bool) error {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	i, err := tx.index(index)
+	if err != nil {
+		return err
+	}
+
+	i.tree.Descend(func(bitem btree.Item) bool {
+		curitem := bitem.(*item)
+		return curitem.visit(iterator, &err)
+	})
+
+	return err
+}
+
+// DescendLessOrEqual iterates over items of index with values less than or equal to pivot
+// in descending order
+func (tx *Transaction) DescendLessOrEqual(index, pivot string, iterator func(key, value string) bool) error {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	i, err := tx.index(index)
+	if err != nil {
+		return err
+	}
+
+	// Items with the pivot value are ordered by key, so the descent starts
+	// from the first item greater than the pivot, which itself is skipped
+	var greater btree.Item
+	i.tree.AscendGreaterOrEqual(&item{value: pivot}, func(bitem btree.Item) bool {
+		if i.sortFn(pivot, bitem.(*item).plainOrEmpty()) {
+			greater = bitem
+			return false
+		}
+		return true
+	})
+
+	i.tree.DescendLessOrEqual(greater, func(bitem btree.Item) bool {
+		if bitem == greater {
+			return true
+		}
+
+		curitem := bitem.(*item)
+		return curitem.visit(iterator, &err)
+	})
+
+	return err
+}
+
+// Aggregate folds items of index with values in [from, to) into initial with reducer
+func (tx *Transaction) Aggregate(index, from, to string, initial interface{},
+	reducer func(acc interface{}, key, value string) interface{}) (interface{}, error) {
+
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	i, err := tx.index(index)
+	if err != nil {
+		return nil, err
+	}
+
+	acc := initial
+	i.tree.AscendRange(&item{value: from}, &item{value: to}, func(bitem btree.Item) bool {
+		curitem := bitem.(*item)
+		var value string
+		if value, err = curitem.plain(); err != nil {
+			return false
+		}
+
+		acc = reducer(acc, string(curitem.key), value)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return acc, nil
+}
+
+// AscendFrom iterates over at most limit items of index starting from position offset.
+// A limit less than or equal to zero means no limit.
+func (tx *Transaction) AscendFrom(index string, offset, limit int, iterator func(key, value string) bool) error {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	i, err := tx.index(index)
+	if err != nil {
+		return err
+	}
+
+	seen := 0
+	i.tree.AscendAt(offset, func(bitem btree.Item) bool {
+		curitem := bitem.(*item)
+		seen++
+		return curitem.visit(iterator, &err) && (limit <= 0 || seen < limit)
+	})
+
+	return err
+}
+
+// Rank returns the position of key in index or ErrNotFound if the index doesn't contain it
+func (tx *Transaction) Rank(index, key string) (int, error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	i, err := tx.index(index)
+	if err != nil {
+		return 0, err
+	}
+
+	revision, err := tx.getKey(dbKey(key))
+	if err != nil {
+		return 0, err
+	}
+
+	if !i.tree.Has(&revision) {
+		return 0, ErrNotFound
+	}
+
+	return i.tree.Rank(&revision), nil
+}
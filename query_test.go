@@ -0,0 +1,191 @@
+package memdb
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func numericLess(a, b string) bool {
+	x, _ := strconv.Atoi(a)
+	y, _ := strconv.Atoi(b)
+	return x < y
+}
+
+func TestTransaction_Count(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("orders", "order.*", numericLess)))
+	for i := 0; i < 1000; i++ {
+		require.Nil(t, tx.Set("order."+strconv.Itoa(i), strconv.Itoa(i%100)))
+	}
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	count, err := tx.Count("orders", "10", "20")
+	require.Nil(t, err)
+	assert.Equal(t, 100, count)
+
+	count, err = tx.Count("orders", "20", "10")
+	require.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	count, err = tx.Count("orders", "0", "1000")
+	require.Nil(t, err)
+	assert.Equal(t, 1000, count)
+
+	_, err = tx.Count("unknown", "0", "1")
+	assert.Equal(t, ErrUnknownIndex, err)
+	require.Nil(t, tx.Commit())
+
+	// Updated items are counted by their new value only
+	tx = db.Begin(true)
+	for i := 0; i < 100; i++ {
+		_, err := tx.Update("order."+strconv.Itoa(i), "50")
+		require.Nil(t, err)
+	}
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	count, err = tx.Count("orders", "0", "1000")
+	require.Nil(t, err)
+	assert.Equal(t, 1000, count)
+
+	count, err = tx.Count("orders", "50", "51")
+	require.Nil(t, err)
+	assert.Equal(t, 109, count)
+}
+
+func TestTransaction_MinMax(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("prices", "price.*", numericLess)))
+
+	_, _, err := tx.Min("prices")
+	assert.Equal(t, ErrNotFound, err)
+
+	require.Nil(t, tx.Set("price.a", "30"))
+	require.Nil(t, tx.Set("price.b", "5"))
+	require.Nil(t, tx.Set("price.c", "100"))
+
+	key, value, err := tx.Min("prices")
+	require.Nil(t, err)
+	assert.Equal(t, "price.b", key)
+	assert.Equal(t, "5", value)
+
+	key, value, err = tx.Max("prices")
+	require.Nil(t, err)
+	assert.Equal(t, "price.c", key)
+	assert.Equal(t, "100", value)
+}
+
+func TestTransaction_Aggregate(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("prices", "price.*", numericLess)))
+	for i := 1; i <= 10; i++ {
+		require.Nil(t, tx.Set("price."+strconv.Itoa(i), strconv.Itoa(i)))
+	}
+
+	sum, err := tx.Aggregate("prices", "3", "6", 0, func(acc interface{}, key, value string) interface{} {
+		v, _ := strconv.Atoi(value)
+		return acc.(int) + v
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 3+4+5, sum)
+}
+
+func TestTransaction_AscendFrom(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("items", "item.*", numericLess)))
+	for i := 0; i < 500; i++ {
+		require.Nil(t, tx.Set("item."+strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	page := func(offset, limit int) []string {
+		got := make([]string, 0)
+		require.Nil(t, tx.AscendFrom("items", offset, limit, func(key, value string) bool {
+			got = append(got, value)
+			return true
+		}))
+		return got
+	}
+
+	assert.Equal(t, []string{"200", "201", "202"}, page(200, 3))
+	assert.Equal(t, []string{"498", "499"}, page(498, 10))
+	assert.Equal(t, []string{}, page(500, 10))
+	assert.Len(t, page(0, 0), 500)
+
+	rank, err := tx.Rank("items", "item.321")
+	require.Nil(t, err)
+	assert.Equal(t, 321, rank)
+
+	_, err = tx.Rank("items", "missing")
+	assert.Equal(t, ErrNotFound, err)
+	require.Nil(t, tx.Commit())
+
+	// An updated item moves to the position of its new value
+	tx = db.Begin(true)
+	_, err = tx.Update("item.100", "1000")
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	assert.Len(t, page(0, 0), 500)
+
+	rank, err = tx.Rank("items", "item.321")
+	require.Nil(t, err)
+	assert.Equal(t, 320, rank)
+
+	rank, err = tx.Rank("items", "item.100")
+	require.Nil(t, err)
+	assert.Equal(t, 499, rank)
+}
+
+func TestTransaction_Pivot(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("ages", "user.*", numericLess)))
+	for key, age := range map[string]string{"user.a": "30", "user.b": "20", "user.c": "30", "user.d": "40", "user.e": "10"} {
+		require.Nil(t, tx.Set(key, age))
+	}
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	collect := func(scan func(iterator func(key, value string) bool) error) []string {
+		keys := make([]string, 0)
+		require.Nil(t, scan(func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		}))
+		return keys
+	}
+
+	assert.Equal(t, []string{"user.a", "user.c", "user.d"}, collect(func(iterator func(key, value string) bool) error {
+		return tx.AscendGreaterOrEqual("ages", "30", iterator)
+	}))
+	assert.Equal(t, []string{"user.d", "user.c", "user.a", "user.b", "user.e"}, collect(func(iterator func(key, value string) bool) error {
+		return tx.Descend("ages", iterator)
+	}))
+	assert.Equal(t, []string{"user.c", "user.a", "user.b", "user.e"}, collect(func(iterator func(key, value string) bool) error {
+		return tx.DescendLessOrEqual("ages", "30", iterator)
+	}))
+	assert.Equal(t, []string{"user.d", "user.c", "user.a", "user.b", "user.e"}, collect(func(iterator func(key, value string) bool) error {
+		return tx.DescendLessOrEqual("ages", "50", iterator)
+	}))
+	assert.Empty(t, collect(func(iterator func(key, value string) bool) error {
+		return tx.DescendLessOrEqual("ages", "5", iterator)
+	}))
+
+	assert.Equal(t, ErrTxNotWritable, tx.RemoveIndex("ages"))
+}
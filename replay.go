@@ -0,0 +1,333 @@
+package memdb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"github.com/tidwall/resp"
+)
+
+// replayChunkSize is the amount of the log read at once and handed to a decoder
+const replayChunkSize = 1 << 20
+
+var ErrCorruptedLog = errors.New("corrupted log")
+
+type replayChunk struct {
+	data  []byte
+	items []fileItem
+	err   error
+	done  chan struct{}
+}
+
+// load replays the log from the global position offset segment by segment and stops
+// at the first error of apply. The active segment is read through the open file,
+// so writes continue at its end. An incomplete record at the end of a writable log,
+// left by an interrupted write, is cut off so new records don't follow it. Frames of
+// an encrypted log prove where a write ended, a plain log only takes an incomplete
+// record shorter than the write buffer for the last write and returns ErrCorruptedLog
+// for a longer one, which is more likely a corrupted record length.
+func (fs *fileStorage) load(offset int64, apply func(items []fileItem) error) error {
+	fs.segMu.Lock()
+	segments := append([]segment{}, fs.segments...)
+	fs.segMu.Unlock()
+
+	if offset < segments[0].base {
+		return ErrMissingSegment
+	}
+
+	last := len(segments) - 1
+	for i, seg := range segments {
+		if i < last && segments[i+1].base <= offset {
+			continue
+		}
+
+		start := offset - seg.base
+		if start < 0 {
+			start = 0
+		}
+
+		if i == last {
+			end, applied, err := fs.replaySegment(fs.file, start, apply)
+			if err != nil || fs.readOnly {
+				return err
+			}
+
+			return fs.truncate(end, applied)
+		}
+
+		f, err := os.Open(seg.path)
+		if os.IsNotExist(err) {
+			return ErrMissingSegment
+		}
+		if err != nil {
+			return err
+		}
+
+		_, _, err = fs.replaySegment(f, start, apply)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// truncate cuts the active segment at end and continues writing there. applied are
+// whole records after end that were replayed already, they are written again as a frame.
+func (fs *fileStorage) truncate(end int64, applied []byte) error {
+	if end >= fs.activeSize {
+		return nil
+	}
+
+	if fs.cipher == nil && fs.activeSize-end > logBufferSize {
+		return ErrCorruptedLog
+	}
+
+	if err := fs.cut(end); err != nil {
+		return err
+	}
+
+	if len(applied) > 0 {
+		fs.buf.Write(applied)
+		if err := fs.commitBoundary(0); err != nil {
+			return err
+		}
+	}
+
+	return fs.file.Sync()
+}
+
+// replaySegment replays a log file from offset. Chunks of whole records are decoded by
+// parallel workers and passed to apply one by one in the log order. An incomplete record
+// at the end of the file, left by an interrupted write, is ignored. It returns the file
+// position after the last whole record that also ends a frame of an encrypted log,
+// and the plaintext of the whole records replayed after that position.
+func (fs *fileStorage) replaySegment(file *os.File, offset int64,
+	apply func(items []fileItem) error) (end int64, applied []byte, err error) {
+
+	if err := fs.checkHeader(file); err != nil {
+		return 0, nil, err
+	}
+
+	// The header was checked, replay starts at the first record
+	if offset < fs.headerSize() {
+		offset = fs.headerSize()
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+
+	counter := &countingReader{r: file}
+	r, err := fs.cipher.reader(counter, offset)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// A frame can end inside a record when a large commit overflows the write buffer,
+	// so an encrypted log can only be cut where a frame ends with a whole record
+	frames, _ := r.(*frameReader)
+	end = offset + counter.n
+	whole := func(rest int) {
+		switch {
+		case frames == nil:
+			end = offset + counter.n - int64(rest)
+		case rest == 0 && len(frames.plain) == 0:
+			end, applied = offset+counter.n, applied[:0]
+		}
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	work := make(chan *replayChunk, workers)
+	ordered := make(chan *replayChunk, workers*2)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for chunk := range work {
+				chunk.items, chunk.err = fs.format.decode(chunk.data)
+				close(chunk.done)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	splitErr := make(chan error, 1)
+	go func() {
+		defer close(work)
+		defer close(ordered)
+		splitErr <- splitRecords(r, fs.format.scan, whole, func(data []byte) bool {
+			if frames != nil {
+				applied = append(applied, data...)
+			}
+
+			chunk := &replayChunk{data: data, done: make(chan struct{})}
+			select {
+			case ordered <- chunk:
+			case <-stop:
+				return false
+			}
+
+			work <- chunk
+			return true
+		})
+	}()
+
+	for chunk := range ordered {
+		<-chunk.done
+		if chunk.err != nil {
+			err = chunk.err
+			break
+		}
+
+		if err = apply(chunk.items); err != nil {
+			break
+		}
+	}
+
+	close(stop)
+	for chunk := range ordered {
+		<-chunk.done
+	}
+
+	if serr := <-splitErr; err == nil {
+		err = serr
+	}
+
+	return end, applied, err
+}
+
+// countingReader counts the bytes read from a file
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// splitRecords reads r and calls fn with chunks that contain only whole records found by scan.
+// whole, if set, is called after every read with the size of the incomplete record read.
+func splitRecords(r io.Reader, scan func(buf []byte) (int, error), whole func(rest int), fn func(data []byte) bool) error {
+	buf := make([]byte, 0, replayChunkSize)
+
+	for {
+		// The buffer doubles, so a record of many chunks is copied a few times only
+		if cap(buf)-len(buf) < replayChunkSize/2 {
+			grown := make([]byte, len(buf), 2*cap(buf))
+			copy(grown, buf)
+			buf = grown
+		}
+
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		end := 0
+		for {
+			size, serr := scan(buf[end:])
+			if serr != nil {
+				return serr
+			}
+			if size == 0 {
+				break
+			}
+			end += size
+		}
+
+		if end > 0 {
+			// Records of the chunk stay untouched, the rest is carried to a new buffer
+			rest := make([]byte, len(buf)-end, len(buf)-end+replayChunkSize)
+			copy(rest, buf[end:])
+			if !fn(buf[:end]) {
+				return nil
+			}
+			buf = rest
+		}
+
+		if whole != nil {
+			whole(len(buf))
+		}
+	}
+}
+
+// scanRecord returns the size of the RESP value at the start of buf
+// or zero if buf doesn't contain the whole value
+func scanRecord(buf []byte) (int, error) {
+	line := bytes.IndexByte(buf, '\n')
+	if line < 0 {
+		return 0, nil
+	}
+
+	if line < 2 || buf[line-1] != '\r' {
+		return 0, ErrCorruptedLog
+	}
+
+	header := buf[1 : line-1]
+	size := line + 1
+
+	switch resp.Type(buf[0]) {
+	case resp.SimpleString, resp.Error, resp.Integer:
+		return size, nil
+	case resp.BulkString:
+		n, ok := parseLength(header)
+		if !ok {
+			return 0, ErrCorruptedLog
+		}
+		if n < 0 {
+			return size, nil
+		}
+		if len(buf) < size+n+2 {
+			return 0, nil
+		}
+		return size + n + 2, nil
+	case resp.Array:
+		n, ok := parseLength(header)
+		if !ok {
+			return 0, ErrCorruptedLog
+		}
+		for i := 0; i < n; i++ {
+			element, err := scanRecord(buf[size:])
+			if err != nil || element == 0 {
+				return 0, err
+			}
+			size += element
+		}
+		return size, nil
+	}
+
+	return 0, ErrCorruptedLog
+}
+
+// parseLength parses a RESP length header without allocations
+func parseLength(b []byte) (int, bool) {
+	if len(b) == 2 && b[0] == '-' && b[1] == '1' {
+		return -1, true
+	}
+
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+
+	return n, true
+}
@@ -0,0 +1,240 @@
+package memdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestSuffix marks the file listing the log segments of a database
+const ManifestSuffix = ".manifest"
+
+var (
+	ErrInvalidManifest = errors.New("invalid segment manifest")
+	ErrMissingSegment  = errors.New("log segment missing")
+)
+
+// segment is a file of the log holding records from the global log position base
+type segment struct {
+	id   int
+	base int64
+	path string
+}
+
+// segmentPath returns the file of the segment, the first one keeps the path of the database
+func segmentPath(path string, id int) string {
+	if id == 0 {
+		return path
+	}
+
+	return fmt.Sprintf("%s.%06d", path, id)
+}
+
+// readManifest returns the segments listed in the manifest, nil if there is no manifest
+func readManifest(path string) ([]segment, error) {
+	f, err := os.Open(path + ManifestSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	segments := make([]segment, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, ErrInvalidManifest
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil || id < 0 {
+			return nil, ErrInvalidManifest
+		}
+
+		base, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || base < 0 {
+			return nil, ErrInvalidManifest
+		}
+
+		if n := len(segments); n > 0 && (id <= segments[n-1].id || base < segments[n-1].base) {
+			return nil, ErrInvalidManifest
+		}
+
+		segments = append(segments, segment{id: id, base: base, path: segmentPath(path, id)})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(segments) == 0 {
+		return nil, ErrInvalidManifest
+	}
+
+	return segments, nil
+}
+
+// writeManifest replaces the manifest atomically
+func writeManifest(path string, segments []segment) error {
+	tmp := path + ManifestSuffix + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, seg := range segments {
+		fmt.Fprintf(w, "%d %d\n", seg.id, seg.base)
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path+ManifestSuffix)
+}
+
+// end returns the global log position after the last written record
+func (fs *fileStorage) end() int64 {
+	fs.segMu.Lock()
+	defer fs.segMu.Unlock()
+
+	return fs.segments[len(fs.segments)-1].base + fs.activeSize
+}
+
+// start returns the global log position of the oldest segment
+func (fs *fileStorage) start() int64 {
+	fs.segMu.Lock()
+	defer fs.segMu.Unlock()
+
+	return fs.segments[0].base
+}
+
+// rotate closes the active segment and continues the log in a new one.
+// It is called by the flush leader only, so writes never race with it.
+func (fs *fileStorage) rotate() error {
+	fs.segMu.Lock()
+	defer fs.segMu.Unlock()
+
+	active := fs.segments[len(fs.segments)-1]
+	next := segment{id: active.id + 1, base: active.base + fs.activeSize}
+	next.path = segmentPath(fs.path, next.id)
+
+	file, err := os.OpenFile(next.path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(file, fs.header()); err != nil {
+		file.Close()
+		os.Remove(next.path)
+		return err
+	}
+
+	segments := append(fs.segments[:len(fs.segments):len(fs.segments)], next)
+	if err := writeManifest(fs.path, segments); err != nil {
+		file.Close()
+		os.Remove(next.path)
+		return err
+	}
+
+	previous := fs.file
+	fs.segments = segments
+	fs.file = file
+	fs.out.w = file
+	fs.activeSize = fs.headerSize()
+	fs.resetSink()
+
+	return previous.Close()
+}
+
+// Compact deletes segments whose records all precede offset. The active segment is kept,
+// the first one is emptied as its file holds the lock of the writer.
+func (fs *fileStorage) Compact(offset int64) error {
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	fs.segMu.Lock()
+	defer fs.segMu.Unlock()
+
+	if !fs.segmented {
+		return nil
+	}
+
+	covered := 0
+	for covered < len(fs.segments)-1 && fs.segments[covered+1].base <= offset {
+		covered++
+	}
+
+	if covered == 0 {
+		return nil
+	}
+
+	removed := fs.segments[:covered]
+	kept := append([]segment{}, fs.segments[covered:]...)
+	if err := writeManifest(fs.path, kept); err != nil {
+		return err
+	}
+	fs.segments = kept
+
+	for _, seg := range removed {
+		// The first segment at the path of the log is the file locked by the writer,
+		// it is emptied instead
+		if seg.path == fs.path {
+			if err := os.Truncate(seg.path, 0); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Shrink starts a new log segment with the current encryption key, writes a snapshot
+// of the database next to the log and deletes the log segments it covers.
+// Without segment rotation the snapshot is written but the log is kept whole.
+// A database without a path keeps its log.
+func (db *Database) Shrink() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	offset, defs, items, err := db.collect(Storage.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	if db.storage == nil || db.path == "" {
+		return nil
+	}
+
+	if err := writeSnapshot(db.path+SnapshotSuffix, offset, defs, items, db.cipher); err != nil {
+		return err
+	}
+
+	return db.storage.Compact(offset)
+}
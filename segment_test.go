@@ -0,0 +1,138 @@
+package memdb
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func removeSegmented(path string) {
+	files, _ := filepath.Glob(path + "*")
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func countKeys(t *testing.T, db *Database) int {
+	count := 0
+	require.Nil(t, db.Begin(false).Keys("*", func(key, value string) bool {
+		count++
+		return true
+	}))
+
+	return count
+}
+
+func TestDatabase_SegmentRotation(t *testing.T) {
+	removeSegmented("segments.db")
+	defer removeSegmented("segments.db")
+
+	db, err := Open("segments.db", Config{Persist: true, SegmentSize: 256})
+	require.Nil(t, err)
+
+	for i := 0; i < 50; i++ {
+		tx := db.Begin(true)
+		require.Nil(t, tx.Set(strconv.Itoa(i), "value "+strconv.Itoa(i)))
+		require.Nil(t, tx.Commit())
+	}
+
+	segments, err := readManifest("segments.db")
+	require.Nil(t, err)
+	assert.True(t, len(segments) > 1)
+	for i, seg := range segments {
+		info, err := os.Stat(seg.path)
+		require.Nil(t, err)
+		if i < len(segments)-1 {
+			assert.True(t, info.Size() >= 256)
+			assert.Equal(t, segments[i+1].base, seg.base+info.Size())
+		}
+	}
+	require.Nil(t, db.Close())
+
+	// Without SegmentSize the manifest is followed and no more segments are created
+	db, err = OpenDB("segments.db", true)
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Delete("0"))
+	require.Nil(t, tx.Commit())
+
+	reopened, err := readManifest("segments.db")
+	require.Nil(t, err)
+	assert.Equal(t, segments, reopened)
+
+	assert.Equal(t, 49, countKeys(t, db))
+
+	tx = db.Begin(false)
+	value, err := tx.Get("49")
+	require.Nil(t, err)
+	assert.Equal(t, "value 49", value)
+	require.Nil(t, db.Close())
+}
+
+func TestDatabase_Shrink(t *testing.T) {
+	removeSegmented("shrink.db")
+	defer removeSegmented("shrink.db")
+
+	db, err := Open("shrink.db", Config{Persist: true, SegmentSize: 256})
+	require.Nil(t, err)
+
+	for i := 0; i < 50; i++ {
+		tx := db.Begin(true)
+		if i < 10 {
+			require.Nil(t, tx.Set(strconv.Itoa(i), "value "+strconv.Itoa(i)))
+		} else {
+			_, err := tx.Update(strconv.Itoa(i%10), "value "+strconv.Itoa(i))
+			require.Nil(t, err)
+		}
+		require.Nil(t, tx.Commit())
+	}
+
+	before, err := readManifest("shrink.db")
+	require.Nil(t, err)
+
+	require.Nil(t, db.Shrink())
+
+	after, err := readManifest("shrink.db")
+	require.Nil(t, err)
+	assert.Len(t, after, 1)
+	assert.Equal(t, before[len(before)-1].id+1, after[0].id)
+
+	// The first segment holds the lock of the writer, it is emptied instead of removed
+	for _, seg := range before {
+		info, err := os.Stat(seg.path)
+		if seg.id == 0 {
+			require.Nil(t, err)
+			assert.Equal(t, int64(0), info.Size())
+			continue
+		}
+		assert.True(t, os.IsNotExist(err))
+	}
+	_, err = OpenDB("shrink.db", true)
+	assert.Equal(t, ErrLocked, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("new", "value"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Close())
+
+	db, err = OpenDB("shrink.db", true)
+	require.Nil(t, err)
+
+	assert.Equal(t, 11, countKeys(t, db))
+
+	tx = db.Begin(false)
+	value, err := tx.Get("9")
+	require.Nil(t, err)
+	assert.Equal(t, "value 49", value)
+	require.Nil(t, db.Close())
+
+	// The log can't be replayed without the snapshot covering the deleted segments
+	require.Nil(t, os.Remove("shrink.db"+SnapshotSuffix))
+	_, err = OpenDB("shrink.db", true)
+	assert.Equal(t, ErrMissingSegment, err)
+}
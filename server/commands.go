@@ -0,0 +1,350 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AplaProject/memdb"
+	"github.com/pkg/errors"
+	"github.com/tidwall/resp"
+)
+
+var ok = resp.SimpleStringValue("OK")
+
+// command is a database command. arity is the number of arguments including the
+// command name, a negative arity is the minimum number.
+type command struct {
+	arity    int
+	writable bool
+	run      func(c *conn, tx *memdb.Transaction, args []string) resp.Value
+}
+
+func (cmd command) accepts(args int) bool {
+	if cmd.arity < 0 {
+		return args >= -cmd.arity
+	}
+
+	return args == cmd.arity
+}
+
+var commands = map[string]command{
+	"ping":   {arity: -1, run: ping},
+	"echo":   {arity: 2, run: echo},
+	"get":    {arity: 2, run: get},
+	"set":    {arity: -3, writable: true, run: set},
+	"setnx":  {arity: 3, writable: true, run: setNX},
+	"del":    {arity: -2, writable: true, run: del},
+	"exists": {arity: -2, run: exists},
+	"keys":   {arity: 2, run: keys},
+	"scan":   {arity: -2, run: scan},
+
+	"createindex": {arity: 4, writable: true, run: createIndex},
+	"dropindex":   {arity: 2, writable: true, run: dropIndex},
+	"ascend":      {arity: -2, run: ascend},
+	"descend":     {arity: -2, run: descend},
+	"len":         {arity: 2, run: length},
+}
+
+func errorf(format string, args ...interface{}) resp.Value {
+	return resp.ErrorValue(fmt.Errorf(format, args...))
+}
+
+// errorReply returns err of the database as a Redis error
+func errorReply(err error) resp.Value {
+	return resp.ErrorValue(errors.New("ERR " + err.Error()))
+}
+
+func bulkStrings(values []string) resp.Value {
+	array := make([]resp.Value, len(values))
+	for i, value := range values {
+		array[i] = resp.StringValue(value)
+	}
+
+	return resp.ArrayValue(array)
+}
+
+func ping(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	switch len(args) {
+	case 0:
+		return resp.SimpleStringValue("PONG")
+	case 1:
+		return resp.StringValue(args[0])
+	}
+
+	return errorf("ERR wrong number of arguments for 'ping' command")
+}
+
+func echo(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	return resp.StringValue(args[0])
+}
+
+func get(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	value, err := tx.Get(args[0])
+	if err == memdb.ErrNotFound {
+		return resp.NullValue()
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return resp.StringValue(value)
+}
+
+// set serves SET key value [NX|XX] [GET]. It replaces the value of an existing key,
+// memdb.Transaction.Set only creates keys. NX only creates the key and XX only replaces
+// it, GET replies the old value instead of OK.
+func set(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	key, value := args[0], args[1]
+
+	var nx, xx, getOld bool
+	for _, option := range args[2:] {
+		switch strings.ToLower(option) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "get":
+			getOld = true
+		default:
+			return errorf("ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return errorf("ERR syntax error")
+	}
+
+	old, err := tx.Get(key)
+	exists := err == nil
+	if err != nil && err != memdb.ErrNotFound {
+		return errorReply(err)
+	}
+
+	reply := ok
+	if getOld {
+		reply = resp.NullValue()
+		if exists {
+			reply = resp.StringValue(old)
+		}
+	}
+
+	if nx && exists || xx && !exists {
+		if getOld {
+			return reply
+		}
+		return resp.NullValue()
+	}
+
+	if exists {
+		_, err = tx.Update(key, value)
+	} else {
+		err = tx.Set(key, value)
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return reply
+}
+
+// setNX serves SETNX key value, it replies 1 when the key was created and 0 when it exists
+func setNX(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	err := tx.Set(args[0], args[1])
+	if err == memdb.ErrAlreadyExists {
+		return resp.IntegerValue(0)
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return resp.IntegerValue(1)
+}
+
+func del(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	deleted := 0
+	for _, key := range args {
+		err := tx.Delete(key)
+		if err == memdb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return errorReply(err)
+		}
+
+		deleted++
+	}
+
+	return resp.IntegerValue(deleted)
+}
+
+func exists(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	found := 0
+	for _, key := range args {
+		_, err := tx.Get(key)
+		if err == memdb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return errorReply(err)
+		}
+
+		found++
+	}
+
+	return resp.IntegerValue(found)
+}
+
+func keys(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	found := make([]string, 0)
+	err := tx.Keys(args[0], func(key, value string) bool {
+		found = append(found, key)
+		return true
+	})
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return bulkStrings(found)
+}
+
+// scan serves SCAN cursor [MATCH pattern] [COUNT count]. Redis clients expect numeric
+// cursors, so the connection maps them to the cursors of memdb.Transaction.Scan.
+func scan(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return errorf("ERR invalid cursor")
+	}
+
+	pattern, count := "*", 0
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errorf("ERR syntax error")
+		}
+
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return errorf("ERR value is not an integer or out of range")
+			}
+		default:
+			return errorf("ERR syntax error")
+		}
+	}
+
+	cursor := ""
+	if id != 0 {
+		var found bool
+		if cursor, found = c.cursors[id]; !found {
+			return errorf("ERR invalid cursor")
+		}
+		delete(c.cursors, id)
+	}
+
+	next, found, err := tx.Scan(pattern, cursor, count)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	id = 0
+	if next != "" {
+		c.lastCursor++
+		id = c.lastCursor
+		c.cursors[id] = next
+	}
+
+	return resp.ArrayValue([]resp.Value{resp.StringValue(strconv.FormatUint(id, 10)), bulkStrings(found)})
+}
+
+// createIndex serves CREATEINDEX name pattern comparator, the comparator is one of the
+// server or registered with memdb.RegisterComparator
+func createIndex(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	index, err := memdb.NewRegisteredIndex(args[0], args[1], args[2])
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if err := tx.AddIndex(index); err != nil {
+		return errorReply(err)
+	}
+
+	return ok
+}
+
+func dropIndex(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	if _, err := tx.IndexStats(args[0]); err != nil {
+		return errorReply(err)
+	}
+
+	if err := tx.RemoveIndex(args[0]); err != nil {
+		return errorReply(err)
+	}
+
+	return ok
+}
+
+// ascend serves ASCEND index [pivot] [LIMIT n], the reply lists keys and values in turn
+func ascend(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	return scanIndex(tx, args, tx.Ascend, tx.AscendGreaterOrEqual)
+}
+
+// descend serves DESCEND index [pivot] [LIMIT n] with the pivot as the greatest value
+func descend(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	return scanIndex(tx, args, tx.Descend, tx.DescendLessOrEqual)
+}
+
+type iterator = func(key, value string) bool
+
+func scanIndex(tx *memdb.Transaction, args []string,
+	all func(index string, fn iterator) error, fromPivot func(index, pivot string, fn iterator) error) resp.Value {
+	index, args := args[0], args[1:]
+
+	pivot, limit := "", -1
+	hasPivot := len(args)%2 == 1
+	if hasPivot {
+		pivot, args = args[0], args[1:]
+	}
+
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && strings.EqualFold(args[0], "limit"):
+		var err error
+		if limit, err = strconv.Atoi(args[1]); err != nil || limit < 0 {
+			return errorf("ERR value is not an integer or out of range")
+		}
+	default:
+		return errorf("ERR syntax error")
+	}
+
+	found := make([]resp.Value, 0)
+	if limit == 0 {
+		return resp.ArrayValue(found)
+	}
+
+	fn := func(key, value string) bool {
+		found = append(found, resp.StringValue(key), resp.StringValue(value))
+		return limit < 0 || len(found) < limit*2
+	}
+
+	var err error
+	if hasPivot {
+		err = fromPivot(index, pivot, fn)
+	} else {
+		err = all(index, fn)
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return resp.ArrayValue(found)
+}
+
+func length(c *conn, tx *memdb.Transaction, args []string) resp.Value {
+	n, err := tx.Len(args[0])
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return resp.IntegerValue(n)
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/AplaProject/memdb"
+)
+
+// Comparators registered by the server for CREATEINDEX. Clients can't send code,
+// other comparators are registered in the server process with memdb.RegisterComparator.
+const (
+	// ComparatorString orders values byte-wise
+	ComparatorString = "string"
+	// ComparatorNumber orders values as decimal numbers, values that are not numbers
+	// come first in byte-wise order
+	ComparatorNumber = "number"
+)
+
+func init() {
+	memdb.RegisterComparator(ComparatorString, func(a, b string) bool {
+		return a < b
+	})
+	memdb.RegisterComparator(ComparatorNumber, lessNumber)
+}
+
+func lessNumber(a, b string) bool {
+	x, xerr := strconv.ParseFloat(a, 64)
+	y, yerr := strconv.ParseFloat(b, 64)
+
+	switch {
+	case xerr != nil && yerr != nil:
+		return a < b
+	case xerr != nil || yerr != nil:
+		return xerr != nil
+	}
+
+	return x < y
+}
@@ -0,0 +1,376 @@
+// Package server serves a memdb database over the Redis protocol, so Redis clients
+// and services written in other languages can use it without embedding the library.
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AplaProject/memdb"
+	"github.com/pkg/errors"
+	"github.com/tidwall/resp"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+// DefaultTxIdleTimeout is the time a transaction started by BEGIN may wait for a command
+const DefaultTxIdleTimeout = 5 * time.Second
+
+// Server serves the commands of a database to Redis clients. Every command runs in its
+// own transaction, commands between MULTI and EXEC run in one writable transaction.
+// BEGIN starts a writable transaction of the connection that commands run in right away
+// until COMMIT or ROLLBACK, like memdb.Database.Begin. It blocks other writers meanwhile.
+type Server struct {
+	// TxIdleTimeout closes the connection of a transaction started by BEGIN and rolls
+	// the transaction back when no command comes for that long, so a client gone quiet
+	// doesn't block the writers. Zero doesn't time out. It is set before Serve is called.
+	TxIdleTimeout time.Duration
+
+	db *memdb.Database
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// New returns a server of db
+func New(db *memdb.Database) *Server {
+	return &Server{
+		TxIdleTimeout: DefaultTxIdleTimeout,
+		db:            db,
+		listeners:     make(map[net.Listener]struct{}),
+		conns:         make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed, it returns ErrServerClosed then
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return ErrServerClosed
+		}
+		s.conns[nc] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(nc)
+	}
+}
+
+// Close stops the listeners, closes the connections and waits for their commands to finish.
+// The database is left open.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+
+	var err error
+	for l := range s.listeners {
+		if lerr := l.Close(); err == nil {
+			err = lerr
+		}
+	}
+
+	for nc := range s.conns {
+		nc.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// conn is the state of a client connection
+type conn struct {
+	rd *resp.Reader
+	wr *bufio.Writer
+
+	// multi queues commands until EXEC, aborted discards them on EXEC
+	// after a command was rejected
+	multi   bool
+	aborted bool
+	queue   [][]string
+
+	// tx is the transaction started by BEGIN
+	tx *memdb.Transaction
+
+	// cursors map the numeric SCAN cursors given to the client to scans of the database
+	cursors    map[uint64]string
+	lastCursor uint64
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer s.wg.Done()
+
+	// Replies of pipelined commands are written at once, when the next command
+	// has to be read from the connection
+	wr := bufio.NewWriter(nc)
+	c := &conn{
+		rd:      resp.NewReader(bufio.NewReader(&flushingReader{r: nc, w: wr})),
+		wr:      wr,
+		cursors: make(map[uint64]string),
+	}
+
+	defer func() {
+		// The transaction of a client gone is dropped
+		if c.tx != nil {
+			c.tx.Rollback()
+		}
+
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		nc.Close()
+	}()
+	w := resp.NewWriter(c.wr)
+
+	for {
+		// The deadline is reset for every command, a pipelined one may be buffered
+		// only in part
+		var timeout time.Time
+		if c.tx != nil && s.TxIdleTimeout > 0 {
+			timeout = time.Now().Add(s.TxIdleTimeout)
+		}
+		if err := nc.SetReadDeadline(timeout); err != nil {
+			return
+		}
+
+		v, _, err := c.rd.ReadValue()
+		if err != nil {
+			return
+		}
+
+		args, ok := commandArgs(v)
+		if !ok {
+			w.WriteError(errors.New("ERR Protocol error: expected an array of bulk strings"))
+			c.wr.Flush()
+			return
+		}
+
+		reply, quit := s.execute(c, args)
+		if err := w.WriteValue(reply); err != nil {
+			return
+		}
+
+		if quit {
+			c.wr.Flush()
+			return
+		}
+	}
+}
+
+// flushingReader flushes w before reading r
+type flushingReader struct {
+	r io.Reader
+	w *bufio.Writer
+}
+
+func (fr *flushingReader) Read(p []byte) (int, error) {
+	if err := fr.w.Flush(); err != nil {
+		return 0, err
+	}
+
+	return fr.r.Read(p)
+}
+
+// commandArgs returns the command name and the arguments sent as an array of bulk strings
+func commandArgs(v resp.Value) ([]string, bool) {
+	if v.Type() != resp.Array || len(v.Array()) == 0 {
+		return nil, false
+	}
+
+	args := make([]string, 0, len(v.Array()))
+	for _, arg := range v.Array() {
+		if arg.Type() != resp.BulkString || arg.IsNull() {
+			return nil, false
+		}
+
+		args = append(args, arg.String())
+	}
+
+	return args, true
+}
+
+// execute runs a command of the client, quit is set when the connection is to be closed
+func (s *Server) execute(c *conn, args []string) (reply resp.Value, quit bool) {
+	name := strings.ToLower(args[0])
+
+	switch name {
+	case "quit":
+		return ok, true
+	case "begin", "commit", "rollback":
+		if len(args) != 1 {
+			return errorf("ERR wrong number of arguments for '%s' command", name), false
+		}
+		if c.multi {
+			c.aborted = true
+			return errorf("ERR %s inside MULTI is not allowed", strings.ToUpper(name)), false
+		}
+		return s.transaction(c, name), false
+	case "multi":
+		if c.multi {
+			return errorf("ERR MULTI calls can not be nested"), false
+		}
+		if c.tx != nil {
+			return errorf("ERR MULTI inside BEGIN is not allowed"), false
+		}
+		c.multi, c.aborted, c.queue = true, false, nil
+		return ok, false
+	case "discard":
+		if !c.multi {
+			return errorf("ERR DISCARD without MULTI"), false
+		}
+		c.multi, c.aborted, c.queue = false, false, nil
+		return ok, false
+	case "exec":
+		if !c.multi {
+			return errorf("ERR EXEC without MULTI"), false
+		}
+		return s.exec(c), false
+	}
+
+	cmd, found := commands[name]
+	if !found {
+		c.aborted = c.multi
+		return errorf("ERR unknown command '%s'", args[0]), false
+	}
+
+	if !cmd.accepts(len(args)) {
+		c.aborted = c.multi
+		return errorf("ERR wrong number of arguments for '%s' command", name), false
+	}
+
+	if c.multi {
+		c.queue = append(c.queue, args)
+		return resp.SimpleStringValue("QUEUED"), false
+	}
+
+	if c.tx != nil {
+		return cmd.run(c, c.tx, args[1:]), false
+	}
+
+	tx := s.db.Begin(cmd.writable)
+	reply = cmd.run(c, tx, args[1:])
+
+	if !cmd.writable {
+		return reply, false
+	}
+
+	if reply.Type() == resp.Error {
+		tx.Rollback()
+		return reply, false
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errorReply(err), false
+	}
+
+	return reply, false
+}
+
+// transaction serves BEGIN, COMMIT and ROLLBACK
+func (s *Server) transaction(c *conn, name string) resp.Value {
+	if name == "begin" {
+		if c.tx != nil {
+			return errorf("ERR BEGIN calls can not be nested")
+		}
+
+		c.tx = s.db.Begin(true)
+		return ok
+	}
+
+	if c.tx == nil {
+		return errorf("ERR %s without BEGIN", strings.ToUpper(name))
+	}
+
+	tx := c.tx
+	c.tx = nil
+
+	var err error
+	if name == "commit" {
+		err = tx.Commit()
+	} else {
+		err = tx.Rollback()
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return ok
+}
+
+// exec runs the queued commands in one transaction and returns their replies
+func (s *Server) exec(c *conn) resp.Value {
+	queue, aborted := c.queue, c.aborted
+	c.multi, c.aborted, c.queue = false, false, nil
+
+	if aborted {
+		return errorf("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	writable := false
+	for _, args := range queue {
+		writable = writable || commands[strings.ToLower(args[0])].writable
+	}
+
+	// Like in Redis, a failing command doesn't stop the others
+	tx := s.db.Begin(writable)
+	replies := make([]resp.Value, 0, len(queue))
+	for _, args := range queue {
+		cmd := commands[strings.ToLower(args[0])]
+		replies = append(replies, cmd.run(c, tx, args[1:]))
+	}
+
+	if writable {
+		if err := tx.Commit(); err != nil {
+			return errorReply(err)
+		}
+	}
+
+	return resp.ArrayValue(replies)
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AplaProject/memdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/resp"
+)
+
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	rd *resp.Reader
+	wr *resp.Writer
+}
+
+func startServer(t *testing.T, db *memdb.Database, configure ...func(srv *Server)) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	srv := New(db)
+	for _, fn := range configure {
+		fn(srv)
+	}
+	go srv.Serve(l)
+
+	return srv, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	nc, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+
+	return &testClient{t: t, nc: nc, rd: resp.NewReader(nc), wr: resp.NewWriter(nc)}
+}
+
+func (c *testClient) send(args ...string) {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.StringValue(arg)
+	}
+
+	require.Nil(c.t, c.wr.WriteArray(values))
+}
+
+func (c *testClient) receive() resp.Value {
+	v, _, err := c.rd.ReadValue()
+	require.Nil(c.t, err)
+	return v
+}
+
+func (c *testClient) do(args ...string) resp.Value {
+	c.send(args...)
+	return c.receive()
+}
+
+func strs(v resp.Value) []string {
+	values := make([]string, 0)
+	for _, value := range v.Array() {
+		values = append(values, value.String())
+	}
+
+	return values
+}
+
+func TestServer_Commands(t *testing.T) {
+	db, err := memdb.OpenDB("", false)
+	require.Nil(t, err)
+	defer db.Close()
+
+	srv, addr := startServer(t, db)
+	defer srv.Close()
+
+	c := dial(t, addr)
+	assert.Equal(t, "PONG", c.do("PING").String())
+	assert.True(t, c.do("GET", "missing").IsNull())
+
+	assert.Equal(t, "OK", c.do("SET", "user:1", "alice").String())
+	assert.Equal(t, "OK", c.do("set", "user:1", "bob").String())
+	assert.Equal(t, "OK", c.do("SET", "user:2", "carol").String())
+	assert.Equal(t, "OK", c.do("SET", "other", "value").String())
+	assert.Equal(t, "bob", c.do("GET", "user:1").String())
+
+	assert.Equal(t, 2, c.do("EXISTS", "user:1", "user:2", "missing").Integer())
+	assert.Equal(t, []string{"user:1", "user:2"}, strs(c.do("KEYS", "user:*")))
+
+	assert.Equal(t, 1, c.do("DEL", "other", "missing").Integer())
+
+	assert.True(t, c.do("SET", "user:1", "dave", "NX").IsNull())
+	assert.True(t, c.do("SET", "user:3", "dave", "XX").IsNull())
+	assert.Equal(t, "bob", c.do("SET", "user:1", "dave", "XX", "GET").String())
+	assert.True(t, c.do("SET", "user:3", "erin", "NX", "GET").IsNull())
+	assert.Equal(t, "erin", c.do("GET", "user:3").String())
+	assert.Equal(t, resp.Error, c.do("SET", "user:3", "erin", "NX", "XX").Type())
+	assert.Equal(t, 0, c.do("SETNX", "user:3", "frank").Integer())
+	assert.Equal(t, 1, c.do("SETNX", "user:4", "frank").Integer())
+	assert.Equal(t, 2, c.do("DEL", "user:3", "user:4").Integer())
+	assert.Equal(t, "OK", c.do("SET", "user:1", "bob").String())
+	assert.Equal(t, 0, c.do("EXISTS", "other").Integer())
+
+	reply := c.do("GET")
+	assert.Equal(t, resp.Error, reply.Type())
+	assert.Equal(t, "ERR wrong number of arguments for 'get' command", reply.String())
+	assert.Equal(t, resp.Error, c.do("UNKNOWN").Type())
+
+	// Pipelined commands are answered in order
+	for i := 0; i < 100; i++ {
+		c.send("SET", "key:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "OK", c.receive().String())
+	}
+
+	scanned := make([]string, 0)
+	cursor := "0"
+	for {
+		reply := c.do("SCAN", cursor, "MATCH", "key:*", "COUNT", "7")
+		require.Equal(t, resp.Array, reply.Type())
+		cursor = reply.Array()[0].String()
+		scanned = append(scanned, strs(reply.Array()[1])...)
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Len(t, scanned, 100)
+	assert.Equal(t, resp.Error, c.do("SCAN", "12345").Type())
+
+	assert.Equal(t, "OK", c.do("QUIT").String())
+}
+
+func TestServer_Multi(t *testing.T) {
+	db, err := memdb.OpenDB("", false)
+	require.Nil(t, err)
+	defer db.Close()
+
+	srv, addr := startServer(t, db)
+	defer srv.Close()
+
+	c := dial(t, addr)
+	other := dial(t, addr)
+
+	assert.Equal(t, "OK", c.do("MULTI").String())
+	assert.Equal(t, "QUEUED", c.do("SET", "1", "first").String())
+	assert.Equal(t, "QUEUED", c.do("SET", "2", "second").String())
+	assert.Equal(t, "QUEUED", c.do("GET", "1").String())
+	assert.Equal(t, "QUEUED", c.do("DEL", "2").String())
+
+	// Queued commands are not visible before EXEC
+	assert.True(t, other.do("GET", "1").IsNull())
+
+	reply := c.do("EXEC")
+	require.Equal(t, resp.Array, reply.Type())
+	assert.Equal(t, []string{"OK", "OK", "first", "1"}, strs(reply))
+	assert.Equal(t, "first", other.do("GET", "1").String())
+
+	assert.Equal(t, "OK", c.do("MULTI").String())
+	assert.Equal(t, "QUEUED", c.do("SET", "3", "third").String())
+	assert.Equal(t, "OK", c.do("DISCARD").String())
+	assert.True(t, other.do("GET", "3").IsNull())
+
+	// A rejected command discards the transaction
+	assert.Equal(t, "OK", c.do("MULTI").String())
+	assert.Equal(t, "QUEUED", c.do("SET", "3", "third").String())
+	assert.Equal(t, resp.Error, c.do("SET", "3").Type())
+	assert.Equal(t, resp.Error, c.do("EXEC").Type())
+	assert.True(t, other.do("GET", "3").IsNull())
+
+	assert.Equal(t, resp.Error, c.do("EXEC").Type())
+	assert.Equal(t, resp.Error, c.do("DISCARD").Type())
+}
+
+func TestServer_Begin(t *testing.T) {
+	db, err := memdb.OpenDB("", false)
+	require.Nil(t, err)
+	defer db.Close()
+
+	srv, addr := startServer(t, db)
+	defer srv.Close()
+
+	c := dial(t, addr)
+	other := dial(t, addr)
+
+	assert.Equal(t, "OK", c.do("BEGIN").String())
+	assert.Equal(t, resp.Error, c.do("BEGIN").Type())
+	assert.Equal(t, resp.Error, c.do("MULTI").Type())
+	assert.Equal(t, "OK", c.do("SET", "1", "first").String())
+
+	// Commands see the writes of the transaction right away, others don't
+	assert.Equal(t, "first", c.do("GET", "1").String())
+	assert.True(t, other.do("GET", "1").IsNull())
+
+	assert.Equal(t, "OK", c.do("COMMIT").String())
+	assert.Equal(t, "first", other.do("GET", "1").String())
+
+	assert.Equal(t, "OK", c.do("BEGIN").String())
+	assert.Equal(t, 1, c.do("DEL", "1").Integer())
+	assert.Equal(t, "OK", c.do("ROLLBACK").String())
+	assert.Equal(t, "first", other.do("GET", "1").String())
+
+	assert.Equal(t, resp.Error, c.do("COMMIT").Type())
+	assert.Equal(t, resp.Error, c.do("ROLLBACK").Type())
+
+	assert.Equal(t, "OK", c.do("MULTI").String())
+	assert.Equal(t, resp.Error, c.do("BEGIN").Type())
+	assert.Equal(t, resp.Error, c.do("EXEC").Type())
+
+	// The transaction of a closed connection is rolled back and other writers go on
+	assert.Equal(t, "OK", c.do("BEGIN").String())
+	assert.Equal(t, "OK", c.do("SET", "2", "second").String())
+	c.nc.Close()
+	assert.Equal(t, "OK", other.do("SET", "3", "third").String())
+	assert.True(t, other.do("GET", "2").IsNull())
+}
+
+func TestServer_TxIdleTimeout(t *testing.T) {
+	db, err := memdb.OpenDB("", false)
+	require.Nil(t, err)
+	defer db.Close()
+
+	srv, addr := startServer(t, db, func(srv *Server) {
+		srv.TxIdleTimeout = 50 * time.Millisecond
+	})
+	defer srv.Close()
+
+	c := dial(t, addr)
+	other := dial(t, addr)
+
+	// Connections without a transaction don't time out
+	assert.Equal(t, "OK", c.do("SET", "1", "first").String())
+	time.Sleep(100 * time.Millisecond)
+
+	// An idle transaction is rolled back and its connection closed, so writers go on
+	assert.Equal(t, "OK", c.do("BEGIN").String())
+	assert.Equal(t, "OK", c.do("SET", "2", "second").String())
+	assert.Equal(t, "OK", other.do("SET", "3", "third").String())
+	assert.True(t, other.do("GET", "2").IsNull())
+
+	_, _, err = c.rd.ReadValue()
+	assert.Error(t, err)
+
+	// A command sent in part after a burst starting the transaction times out as well
+	c = dial(t, addr)
+	_, err = c.nc.Write([]byte("*1\r\n$5\r\nBEGIN\r\n*3\r\n$3\r\nSET\r\n$1\r\n4\r\n$6\r\nfourth\r\n*2\r\n$3\r\nGET"))
+	require.Nil(t, err)
+	for _, expected := range []string{"OK", "OK"} {
+		v, _, err := c.rd.ReadValue()
+		require.Nil(t, err)
+		assert.Equal(t, expected, v.String())
+	}
+	_, _, err = c.rd.ReadValue()
+	assert.Error(t, err)
+	assert.Equal(t, "OK", other.do("SET", "5", "fifth").String())
+	assert.True(t, other.do("GET", "4").IsNull())
+}
+
+func TestServer_ReadOnly(t *testing.T) {
+	db, err := memdb.OpenDB("server.db", true)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+	defer removeFiles("server.db")
+
+	db, err = memdb.Open("server.db", memdb.Config{Persist: true, ReadOnly: true})
+	require.Nil(t, err)
+	defer db.Close()
+
+	srv, addr := startServer(t, db)
+	defer srv.Close()
+
+	c := dial(t, addr)
+	reply := c.do("SET", "1", "value")
+	assert.Equal(t, resp.Error, reply.Type())
+	assert.Equal(t, "ERR "+memdb.ErrTxNotWritable.Error(), reply.String())
+}
+
+func TestServer_Close(t *testing.T) {
+	db, err := memdb.OpenDB("", false)
+	require.Nil(t, err)
+	defer db.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	srv := New(db)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	c := dial(t, l.Addr().String())
+	assert.Equal(t, "PONG", c.do("PING").String())
+
+	require.Nil(t, srv.Close())
+	assert.Equal(t, ErrServerClosed, <-served)
+
+	_, _, err = c.rd.ReadValue()
+	assert.NotNil(t, err)
+}
+
+func removeFiles(path string) {
+	files, _ := filepath.Glob(path + "*")
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func TestServer_Indexes(t *testing.T) {
+	db, err := memdb.OpenDB("", false)
+	require.Nil(t, err)
+	defer db.Close()
+
+	srv, addr := startServer(t, db)
+	defer srv.Close()
+
+	c := dial(t, addr)
+	for key, age := range map[string]string{"user:a": "30", "user:b": "9", "user:c": "30", "user:d": "100", "other": "1"} {
+		require.Equal(t, "OK", c.do("SET", key, age).String())
+	}
+
+	assert.Equal(t, "OK", c.do("CREATEINDEX", "ages", "user:*", ComparatorNumber).String())
+	assert.Equal(t, "OK", c.do("CREATEINDEX", "ages", "user:*", ComparatorNumber).String())
+	assert.Equal(t, resp.Error, c.do("CREATEINDEX", "ages", "*", ComparatorNumber).Type())
+	assert.Equal(t, resp.Error, c.do("CREATEINDEX", "other", "*", "unknown").Type())
+	assert.Equal(t, 4, c.do("LEN", "ages").Integer())
+
+	assert.Equal(t, []string{"user:b", "9", "user:a", "30", "user:c", "30", "user:d", "100"}, strs(c.do("ASCEND", "ages")))
+	assert.Equal(t, []string{"user:a", "30", "user:c", "30"}, strs(c.do("ASCEND", "ages", "30", "LIMIT", "2")))
+	assert.Equal(t, []string{"user:b", "9"}, strs(c.do("ascend", "ages", "limit", "1")))
+	assert.Equal(t, []string{"user:d", "100", "user:c", "30"}, strs(c.do("DESCEND", "ages", "LIMIT", "2")))
+	assert.Equal(t, []string{"user:c", "30", "user:a", "30", "user:b", "9"}, strs(c.do("DESCEND", "ages", "50")))
+	assert.Empty(t, strs(c.do("ASCEND", "ages", "LIMIT", "0")))
+	assert.Equal(t, resp.Error, c.do("ASCEND", "ages", "1", "2").Type())
+
+	// Overwriting an indexed key replaces its entry
+	assert.Equal(t, "OK", c.do("SET", "user:b", "31").String())
+	assert.Equal(t, "OK", c.do("SET", "user:b", "200").String())
+	assert.Equal(t, 4, c.do("LEN", "ages").Integer())
+	assert.Equal(t, []string{"user:a", "30", "user:c", "30", "user:d", "100", "user:b", "200"}, strs(c.do("ASCEND", "ages")))
+	assert.Equal(t, "OK", c.do("SET", "user:b", "9").String())
+
+	// Index changes are visible to the commands of a transaction
+	assert.Equal(t, "OK", c.do("MULTI").String())
+	assert.Equal(t, "QUEUED", c.do("SET", "user:e", "1").String())
+	assert.Equal(t, "QUEUED", c.do("ASCEND", "ages", "LIMIT", "1").String())
+	assert.Equal(t, "QUEUED", c.do("DROPINDEX", "ages").String())
+	reply := c.do("EXEC")
+	require.Equal(t, resp.Array, reply.Type())
+	assert.Equal(t, []string{"user:e", "1"}, strs(reply.Array()[1]))
+	assert.Equal(t, "OK", reply.Array()[2].String())
+
+	assert.Equal(t, resp.Error, c.do("LEN", "ages").Type())
+	assert.Equal(t, resp.Error, c.do("DROPINDEX", "ages").Type())
+}
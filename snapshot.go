@@ -0,0 +1,548 @@
+package memdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/tidwall/btree"
+)
+
+// snapshotMagic starts every snapshot file
+const snapshotMagic = "MEMDBSN1"
+
+// maxSnapshotField rejects field sizes of a corrupted snapshot that don't fit an int
+// on 32-bit platforms
+const maxSnapshotField = math.MaxInt32
+
+// snapshotChunkSize limits how far allocations run ahead of the data read, a corrupted
+// field size fails at the end of the file instead of allocating the whole field
+const snapshotChunkSize = 1 << 20
+
+// SnapshotSuffix marks snapshot files of a database, OpenDB loads the newest
+// valid snapshot named <path>.snapshot* before replaying the log
+const SnapshotSuffix = ".snapshot"
+
+var (
+	ErrClosed          = errors.New("database closed")
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+)
+
+type indexDef struct {
+	text       bool
+	name       string
+	pattern    string
+	comparator string
+}
+
+// Snapshot writes the committed items ordered by key and the index definitions to path.
+// Writers are blocked only while the keys are cloned.
+// The file also records the log position it covers, so OpenDB replays only later records.
+// It is encrypted like the log.
+func (db *Database) Snapshot(path string) error {
+	offset, defs, items, err := db.collect(Storage.Sync)
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshot(path, offset, defs, items, db.cipher)
+}
+
+// collect returns the committed state, with drain the log position covering it.
+// Writers are blocked while the keyspace is cloned, the items are copied after that
+// and the committed items replaced in the meantime are kept for the copy.
+func (db *Database) collect(drain func(s Storage) (int64, error)) (int64, []indexDef, []*item, error) {
+	db.writeTx.Lock()
+
+	if db.closed {
+		db.writeTx.Unlock()
+		return 0, nil, nil, ErrClosed
+	}
+
+	var offset int64
+	if drain != nil && db.storage != nil {
+		var err error
+		offset, err = drain(db.storage)
+		if err != nil {
+			db.writeTx.Unlock()
+			return 0, nil, nil, err
+		}
+	}
+
+	defs := db.indexes.definitions()
+	c := db.items.startCopy()
+	db.writeTx.Unlock()
+
+	return offset, defs, db.items.finishCopy(c), nil
+}
+
+// committed returns committed items ordered by key
+func (it *Items) committed() []*item {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+
+	items := make([]*item, 0, len(it.storage))
+	it.keyspace.Ascend(func(bitem btree.Item) bool {
+		dbItem := it.storage[dbKey(bitem.(keyItem))]
+
+		dbItem.RLock()
+		if dbItem.current != nil {
+			items = append(items, dbItem.current)
+		}
+		dbItem.RUnlock()
+
+		return true
+	})
+
+	return items
+}
+
+// itemsCopy is a copy of the committed items being made, replaced keeps the committed
+// items of the keys changed since the copy started
+type itemsCopy struct {
+	keyspace *btree.BTree
+	replaced map[dbKey]*item
+}
+
+// startCopy clones the keyspace, the caller must hold the write lock
+func (it *Items) startCopy() *itemsCopy {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	c := &itemsCopy{keyspace: it.keyspace.Clone(), replaced: make(map[dbKey]*item)}
+	if it.copies == nil {
+		it.copies = make(map[*itemsCopy]struct{})
+	}
+	it.copies[c] = struct{}{}
+	atomic.AddInt32(&it.copying, 1)
+
+	return c
+}
+
+// finishCopy returns the committed items of c ordered by key
+func (it *Items) finishCopy(c *itemsCopy) []*item {
+	items := make([]*item, 0, c.keyspace.Len())
+	c.keyspace.Ascend(func(bitem btree.Item) bool {
+		key := dbKey(bitem.(keyItem))
+
+		it.mu.RLock()
+		current, ok := c.replaced[key]
+		if dbItem := it.storage[key]; !ok && dbItem != nil {
+			dbItem.RLock()
+			current = dbItem.current
+			dbItem.RUnlock()
+		}
+		it.mu.RUnlock()
+
+		if current != nil {
+			items = append(items, current)
+		}
+		return true
+	})
+
+	it.mu.Lock()
+	delete(it.copies, c)
+	atomic.AddInt32(&it.copying, -1)
+	it.mu.Unlock()
+
+	return items
+}
+
+// replacing keeps the committed item of key for the copies being made before a commit changes it
+func (it *Items) replacing(key dbKey) {
+	if atomic.LoadInt32(&it.copying) == 0 {
+		return
+	}
+
+	it.mu.Lock()
+	it.preserve(key)
+	it.mu.Unlock()
+}
+
+// preserve is replacing for callers holding the lock of it
+func (it *Items) preserve(key dbKey) {
+	if len(it.copies) == 0 {
+		return
+	}
+
+	var current *item
+	if dbItem := it.storage[key]; dbItem != nil {
+		dbItem.RLock()
+		current = dbItem.current
+		dbItem.RUnlock()
+	}
+
+	for c := range it.copies {
+		if _, ok := c.replaced[key]; !ok {
+			c.replaced[key] = current
+		}
+	}
+}
+
+func (idxer *Indexes) definitions() []indexDef {
+	defs := make([]indexDef, 0)
+	merged := idxer.merge()
+
+	for _, index := range merged.storage {
+		defs = append(defs, indexDef{name: index.name, pattern: index.pattern, comparator: index.comparator})
+	}
+
+	for _, index := range merged.text {
+		defs = append(defs, indexDef{text: true, name: index.name, pattern: index.pattern})
+	}
+
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].name < defs[j].name
+	})
+
+	return defs
+}
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	sw.w.Write(p)
+	sw.crc.Write(p)
+}
+
+func (sw *snapshotWriter) writeUvarint(v uint64) {
+	n := binary.PutUvarint(sw.buf[:], v)
+	sw.write(sw.buf[:n])
+}
+
+func (sw *snapshotWriter) writeString(s string) {
+	sw.writeUvarint(uint64(len(s)))
+	sw.write([]byte(s))
+}
+
+func writeSnapshot(path string, offset int64, defs []indexDef, items []*item, c *logCipher) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeHeader(f)
+	if err == nil {
+		err = encodeSnapshot(c.writer(f, c.headerSize()), offset, defs, items)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func encodeSnapshot(w io.Writer, offset int64, defs []indexDef, items []*item) error {
+	sw := &snapshotWriter{w: bufio.NewWriterSize(w, logBufferSize), crc: crc32.NewIEEE()}
+	sw.write([]byte(snapshotMagic))
+
+	var fixed [8]byte
+	binary.BigEndian.PutUint64(fixed[:], uint64(offset))
+	sw.write(fixed[:])
+
+	sw.writeUvarint(uint64(len(defs)))
+	for _, def := range defs {
+		if def.text {
+			sw.write([]byte{1})
+		} else {
+			sw.write([]byte{0})
+		}
+
+		sw.writeString(def.name)
+		sw.writeString(def.pattern)
+		sw.writeString(def.comparator)
+	}
+
+	sw.writeUvarint(uint64(len(items)))
+	for _, item := range items {
+		value, err := item.plain()
+		if err != nil {
+			return err
+		}
+
+		sw.writeString(string(item.key))
+		sw.writeString(value)
+	}
+
+	binary.BigEndian.PutUint32(fixed[:4], sw.crc.Sum32())
+	sw.w.Write(fixed[:4])
+
+	return sw.w.Flush()
+}
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (sr *snapshotReader) read(n uint64) ([]byte, error) {
+	if n > maxSnapshotField {
+		return nil, ErrInvalidSnapshot
+	}
+
+	var p []byte
+	for uint64(len(p)) < n {
+		chunk := n - uint64(len(p))
+		if chunk > snapshotChunkSize {
+			chunk = snapshotChunkSize
+		}
+
+		start := len(p)
+		p = append(p, make([]byte, chunk)...)
+		if _, err := io.ReadFull(sr.r, p[start:]); err != nil {
+			return nil, err
+		}
+	}
+
+	sr.crc.Write(p)
+	return p, nil
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	sr.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (sr *snapshotReader) readString() (string, error) {
+	n, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := sr.read(n)
+	return string(p), err
+}
+
+// openSnapshot opens the snapshot at path for reading its plaintext
+func openSnapshot(path string, c *logCipher) (*os.File, io.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.checkEncryption(f); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	r, err := c.reader(f, 0)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, r, nil
+}
+
+// readSnapshotOffset returns the log position covered by the snapshot
+func readSnapshotOffset(path string, c *logCipher) (int64, error) {
+	f, r, err := openSnapshot(path, c)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(snapshotMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, ErrInvalidSnapshot
+	}
+
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, ErrInvalidSnapshot
+	}
+
+	return int64(binary.BigEndian.Uint64(header[len(snapshotMagic):])), nil
+}
+
+// readSnapshot loads a snapshot into items and verifies its checksum
+func readSnapshot(path string, items *Items, c *logCipher, comp *compression) (int64, []indexDef, error) {
+	f, r, err := openSnapshot(path, c)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	return decodeSnapshot(r, items, comp)
+}
+
+func decodeSnapshot(r io.Reader, items *Items, comp *compression) (int64, []indexDef, error) {
+	sr := &snapshotReader{r: bufio.NewReaderSize(r, logBufferSize), crc: crc32.NewIEEE()}
+	fail := func(err error) (int64, []indexDef, error) {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrInvalidSnapshot
+		}
+		return 0, nil, err
+	}
+
+	header, err := sr.read(uint64(len(snapshotMagic) + 8))
+	if err != nil {
+		return fail(err)
+	}
+
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return fail(ErrInvalidSnapshot)
+	}
+	offset := int64(binary.BigEndian.Uint64(header[len(snapshotMagic):]))
+
+	count, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return fail(err)
+	}
+
+	defs := make([]indexDef, 0)
+	for i := uint64(0); i < count; i++ {
+		kind, err := sr.ReadByte()
+		if err != nil {
+			return fail(err)
+		}
+
+		def := indexDef{text: kind == 1}
+		for _, field := range []*string{&def.name, &def.pattern, &def.comparator} {
+			if *field, err = sr.readString(); err != nil {
+				return fail(err)
+			}
+		}
+
+		defs = append(defs, def)
+	}
+
+	count, err = binary.ReadUvarint(sr)
+	if err != nil {
+		return fail(err)
+	}
+
+	for i := uint64(0); i < count; i++ {
+		key, err := sr.readString()
+		if err != nil {
+			return fail(err)
+		}
+
+		value, err := sr.readString()
+		if err != nil {
+			return fail(err)
+		}
+
+		current := &item{key: dbKey(key), value: value}
+		comp.pack(current)
+		items.set(dbKey(key), &dbItem{key: dbKey(key), current: current})
+	}
+
+	sum := sr.crc.Sum32()
+	var trailer [4]byte
+	if _, err := io.ReadFull(sr.r, trailer[:]); err != nil {
+		return fail(err)
+	}
+
+	if binary.BigEndian.Uint32(trailer[:]) != sum {
+		return fail(ErrInvalidSnapshot)
+	}
+
+	return offset, defs, nil
+}
+
+// loadSnapshot loads the newest valid snapshot of the log at path into the database
+// and returns the log position to replay from and the index definitions. Snapshots
+// outside of the log positions from start to end don't match the remaining log.
+func (db *Database) loadSnapshot(path string, start, end int64) (int64, []indexDef) {
+	if path == "" {
+		return 0, nil
+	}
+
+	files, err := filepath.Glob(path + SnapshotSuffix + "*")
+	if err != nil {
+		return 0, nil
+	}
+
+	type candidate struct {
+		path   string
+		offset int64
+	}
+
+	candidates := make([]candidate, 0)
+	for _, file := range files {
+		if strings.HasSuffix(file, ".tmp") {
+			continue
+		}
+
+		offset, err := readSnapshotOffset(file, db.cipher)
+		if err != nil || offset < start || offset > end {
+			continue
+		}
+
+		candidates = append(candidates, candidate{path: file, offset: offset})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].offset > candidates[j].offset
+	})
+
+	for _, c := range candidates {
+		offset, defs, err := readSnapshot(c.path, &db.items, db.cipher, db.compression)
+		if err != nil {
+			db.items = newItems()
+			continue
+		}
+
+		return offset, defs
+	}
+
+	return 0, nil
+}
+
+// restoreIndexes creates indexes from definitions and fills them with committed items.
+// Indexes with comparators that are not registered are skipped and so are not
+// in the definitions written by later snapshots.
+func (db *Database) restoreIndexes(defs []indexDef) {
+	if len(defs) == 0 {
+		return
+	}
+
+	indexes := newIndexer()
+	for _, def := range defs {
+		if def.text {
+			indexes.AddTextIndex(NewTextIndex(def.name, def.pattern))
+			continue
+		}
+
+		index, err := NewRegisteredIndex(def.name, def.pattern, def.comparator)
+		if err != nil {
+			continue
+		}
+
+		indexes.AddIndex(index)
+	}
+
+	for _, item := range db.items.committed() {
+		indexes.Insert(item)
+	}
+
+	db.setIndexes(indexes)
+}
@@ -0,0 +1,226 @@
+package memdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabase_Snapshot(t *testing.T) {
+	os.RemoveAll("test.db")
+	os.RemoveAll("test.db" + SnapshotSuffix)
+	defer os.RemoveAll("test.db" + SnapshotSuffix)
+
+	RegisterComparator("length", func(a, b string) bool {
+		return len(a) < len(b)
+	})
+
+	db, err := OpenDB("test.db", true)
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	index, err := NewRegisteredIndex("by-length", "*", "length")
+	require.Nil(t, err)
+	require.Nil(t, tx.AddIndex(index))
+	require.Nil(t, tx.AddTextIndex(NewTextIndex("text", "*")))
+	require.Nil(t, tx.Set("1", "first value"))
+	require.Nil(t, tx.Set("2", "second"))
+	require.Nil(t, tx.Set("3", "third"))
+	require.Nil(t, tx.Commit())
+
+	require.Nil(t, db.Snapshot("test.db"+SnapshotSuffix))
+
+	tx = db.Begin(true)
+	_, err = tx.Update("2", "2")
+	require.Nil(t, err)
+	require.Nil(t, tx.Delete("3"))
+	require.Nil(t, tx.Set("4", "fourth value"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Close())
+
+	// Records covered by the snapshot are not replayed, so a damaged head of the log is not read
+	f, err := os.OpenFile("test.db", os.O_RDWR, 0666)
+	require.Nil(t, err)
+	_, err = f.WriteAt([]byte("X"), 0)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	db, err = OpenDB("test.db", true)
+	require.Nil(t, err)
+
+	tx = db.Begin(false)
+	for key, expected := range map[string]string{"1": "first value", "2": "2", "4": "fourth value"} {
+		value, err := tx.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, expected, value)
+	}
+
+	_, err = tx.Get("3")
+	assert.Equal(t, ErrNotFound, err)
+
+	got := make([]string, 0)
+	require.Nil(t, tx.Ascend("by-length", func(key, value string) bool {
+		got = append(got, key)
+		return true
+	}))
+	assert.Equal(t, []string{"2", "1", "4"}, got)
+
+	got = make([]string, 0)
+	require.Nil(t, tx.Search("text", "value", func(key, value string) bool {
+		got = append(got, key)
+		return true
+	}))
+	assert.Equal(t, []string{"1", "4"}, got)
+
+	stats, err := tx.IndexStats("by-length")
+	require.Nil(t, err)
+	assert.Equal(t, "length", stats.Comparator)
+	require.Nil(t, db.Close())
+}
+
+func TestDatabase_SnapshotIndexDefinitions(t *testing.T) {
+	os.RemoveAll("test.db")
+	os.RemoveAll("test.db" + SnapshotSuffix)
+	defer os.RemoveAll("test.db")
+	defer os.RemoveAll("test.db" + SnapshotSuffix)
+
+	RegisterComparator("restored-length", func(a, b string) bool {
+		return len(a) < len(b)
+	})
+	byLength := func() *Index {
+		index, err := NewRegisteredIndex("restored", "*", "restored-length")
+		require.Nil(t, err)
+		return index
+	}
+	unregistered := func() *Index {
+		return NewIndex("unregistered", "*", func(a, b string) bool { return a < b })
+	}
+
+	db, err := OpenDB("test.db", true)
+	require.Nil(t, err)
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(byLength(), unregistered()))
+	require.Nil(t, tx.AddTextIndex(NewTextIndex("text", "*")))
+	require.Nil(t, tx.Set("1", "first"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Snapshot("test.db"+SnapshotSuffix))
+	require.Nil(t, db.Close())
+
+	// The index of a comparator that is not registered is dropped
+	db, err = OpenDB("test.db", true)
+	require.Nil(t, err)
+	defer db.Close()
+	_, err = db.Begin(false).IndexStats("unregistered")
+	assert.NotNil(t, err)
+
+	require.Nil(t, db.Snapshot("test.db"+SnapshotSuffix))
+	items := newItems()
+	_, defs, err := readSnapshot("test.db"+SnapshotSuffix, &items, nil, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []indexDef{
+		{name: "restored", pattern: "*", comparator: "restored-length"},
+		{text: true, name: "text", pattern: "*"},
+	}, defs)
+
+	// Restored indexes are added again with the same definition only
+	tx = db.Begin(true)
+	require.Nil(t, tx.AddIndex(byLength(), unregistered()))
+	require.Nil(t, tx.AddTextIndex(NewTextIndex("text", "*")))
+	assert.Equal(t, ErrIndexExists, tx.AddTextIndex(NewTextIndex("text", "user.*")))
+	other, err := NewRegisteredIndex("restored", "user.*", "restored-length")
+	require.Nil(t, err)
+	assert.Equal(t, ErrIndexExists, tx.AddIndex(other))
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	for _, name := range []string{"restored", "unregistered"} {
+		length, err := tx.Len(name)
+		require.Nil(t, err)
+		assert.Equal(t, 1, length)
+	}
+}
+
+func TestDatabase_SnapshotInvalid(t *testing.T) {
+	os.RemoveAll("test.db")
+	defer os.RemoveAll("test.db" + SnapshotSuffix + ".1")
+	defer os.RemoveAll("test.db" + SnapshotSuffix + ".2")
+
+	db, err := OpenDB("test.db", true)
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "first"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Snapshot("test.db"+SnapshotSuffix+".1"))
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Set("2", "second"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Snapshot("test.db"+SnapshotSuffix+".2"))
+	require.Nil(t, db.Close())
+
+	// Damage the newest snapshot, the older one and the log are used instead
+	data, err := os.ReadFile("test.db" + SnapshotSuffix + ".2")
+	require.Nil(t, err)
+	data[len(data)-5] ^= 0xff
+	require.Nil(t, os.WriteFile("test.db"+SnapshotSuffix+".2", data, 0666))
+
+	items := newItems()
+	_, _, err = readSnapshot("test.db"+SnapshotSuffix+".2", &items, nil, nil)
+	assert.Equal(t, ErrInvalidSnapshot, err)
+
+	db, err = OpenDB("test.db", true)
+	require.Nil(t, err)
+
+	tx = db.Begin(false)
+	for _, key := range []string{"1", "2"} {
+		_, err := tx.Get(key)
+		assert.Nil(t, err)
+	}
+
+	// A corrupted field size fails at the end of the data without allocating the field
+	corrupted := append([]byte(snapshotMagic), make([]byte, 8)...)
+	corrupted = append(corrupted, 1, 0)
+	var size [binary.MaxVarintLen64]byte
+	corrupted = append(corrupted, size[:binary.PutUvarint(size[:], maxSnapshotField)]...)
+	corrupted = append(corrupted, "name"...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err = decodeSnapshot(bytes.NewReader(corrupted), &items, nil)
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, ErrInvalidSnapshot, err)
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 16<<20, "allocated %d", after.TotalAlloc-before.TotalAlloc)
+}
+
+func TestItems_Copy(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "first"))
+	require.Nil(t, tx.Set("2", "second"))
+	require.Nil(t, tx.Commit())
+
+	db.writeTx.Lock()
+	c := db.items.startCopy()
+	db.writeTx.Unlock()
+
+	// Commits after the copy started don't change it
+	tx = db.Begin(true)
+	_, err := tx.Update("1", "changed")
+	require.Nil(t, err)
+	require.Nil(t, tx.Delete("2"))
+	require.Nil(t, tx.Set("3", "third"))
+	require.Nil(t, tx.Commit())
+
+	items := db.items.finishCopy(c)
+	require.Len(t, items, 2)
+	assert.Equal(t, item{key: "1", value: "first"}, *items[0])
+	assert.Equal(t, item{key: "2", value: "second"}, *items[1])
+	assert.Empty(t, db.items.copies)
+}
@@ -0,0 +1,131 @@
+package memdb
+
+// Storage persists committed changes of a database as a log of records.
+// Positions in the log are opaque to the database, they are only compared
+// and recorded in snapshots.
+type Storage interface {
+	// Append queues records of a commit, it is called in commit order while the database
+	// blocks other writers. The returned function waits until the records are durable,
+	// records of earlier calls must be durable by then as well.
+	Append(records []Record) func() error
+	// Sync waits until all appended records are durable and returns the end of the log
+	Sync() (int64, error)
+	// Snapshot is Sync for a snapshot of the database, the storage can start a new file
+	// so the records covered by the snapshot can be removed by Compact
+	Snapshot() (int64, error)
+	// Replay calls apply with the records from position offset in the log order
+	Replay(offset int64, apply func(records []Record) error) error
+	// Bounds returns the positions of the oldest record kept and of the end of the log
+	Bounds() (start, end int64)
+	// Compact may remove records before offset, which are covered by a snapshot
+	Compact(offset int64) error
+	Stats() LogStats
+	Close() error
+}
+
+// Record is a change of a key in the log
+type Record struct {
+	// Delete marks a removed key, otherwise Value is set for Key
+	Delete bool
+	Key    string
+	Value  string
+	// Codec is the name of the compressor of Value, empty for a plain value
+	Codec string
+}
+
+// record returns the log record of a set or removed item
+func (i *item) record(deleted bool) Record {
+	if deleted {
+		return Record{Delete: true, Key: string(i.key)}
+	}
+
+	r := Record{Key: string(i.key), Value: i.value}
+	if i.codec != nil {
+		r.Codec = i.codec.name
+	}
+
+	return r
+}
+
+// fileItem returns the record as a file log item
+func (r Record) fileItem() (fileItem, error) {
+	fi := fileItem{item: item{key: dbKey(r.Key), value: r.Value}, command: commandSET}
+	if r.Delete {
+		fi.command = commandDEL
+	}
+
+	if r.Codec != "" {
+		if fi.codec = getCompressor(r.Codec); fi.codec == nil {
+			return fi, ErrUnknownCompressor
+		}
+	}
+
+	return fi, nil
+}
+
+// OpenFileStorage opens the log file at path the way Open does with Config.Persist.
+// Format, segment rotation, encryption and compression of config apply to it.
+func OpenFileStorage(path string, config Config) (Storage, error) {
+	c, err := newLogCipher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	comp, err := newCompression(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return openConfiguredStorage(path, config, c, comp)
+}
+
+func openConfiguredStorage(path string, config Config, c *logCipher, comp *compression) (*fileStorage, error) {
+	format, err := getFormat(config.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	return openFileStorage(path, fileOptions{
+		format:      format,
+		segmentSize: config.SegmentSize,
+		cipher:      c,
+		compression: comp,
+		readOnly:    config.ReadOnly,
+	})
+}
+
+func (fs *fileStorage) Append(records []Record) func() error {
+	if fs.readOnly {
+		return func() error { return ErrReadOnly }
+	}
+
+	items := make([]fileItem, 0, len(records))
+	for _, r := range records {
+		item, err := r.fileItem()
+		if err != nil {
+			return func() error { return err }
+		}
+
+		items = append(items, item)
+	}
+
+	req := fs.enqueue(items)
+	return func() error {
+		return fs.wait(req)
+	}
+}
+
+func (fs *fileStorage) Replay(offset int64, apply func(records []Record) error) error {
+	return fs.load(offset, func(items []fileItem) error {
+		records := make([]Record, len(items))
+		for i := range items {
+			records[i] = items[i].record(items[i].command == commandDEL)
+		}
+
+		return apply(records)
+	})
+}
+
+func (fs *fileStorage) Bounds() (int64, int64) {
+	return fs.start(), fs.end()
+}
@@ -0,0 +1,142 @@
+package memdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabase_CloseWithoutStorage(t *testing.T) {
+	db, err := OpenDB("", false)
+	require.Nil(t, err)
+
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Close())
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	db, err := Open("", Config{Storage: storage})
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "first"))
+	require.Nil(t, tx.Set("2", "second"))
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(true)
+	_, err = tx.Update("1", "updated")
+	require.Nil(t, err)
+	require.Nil(t, tx.Delete("2"))
+	require.Nil(t, tx.Commit())
+
+	records := storage.Records()
+	assert.Len(t, records, 5)
+	// Keys of a commit are written in no particular order
+	assert.ElementsMatch(t, []Record{
+		{Delete: true, Key: "1"}, {Key: "1", Value: "updated"}, {Delete: true, Key: "2"},
+	}, records[2:])
+	assert.Equal(t, int64(2), db.LogStats().Commits)
+	require.Nil(t, db.Close())
+
+	db, err = Open("", Config{Storage: storage})
+	require.Nil(t, err)
+
+	value, err := db.Begin(false).Get("1")
+	require.Nil(t, err)
+	assert.Equal(t, "updated", value)
+	_, err = db.Begin(false).Get("2")
+	assert.Equal(t, ErrNotFound, err)
+
+	require.Nil(t, storage.Compact(3))
+	start, end := storage.Bounds()
+	assert.Equal(t, int64(3), start)
+	assert.Equal(t, int64(5), end)
+	assert.Equal(t, ErrMissingSegment, storage.Replay(0, func(records []Record) error {
+		return nil
+	}))
+}
+
+func TestBinaryStorage(t *testing.T) {
+	removeSegmented("binary.db")
+	defer removeSegmented("binary.db")
+
+	config := Config{Format: FormatBinary, SegmentSize: 256, Compression: "flate"}
+	storage, err := OpenFileStorage("binary.db", config)
+	require.Nil(t, err)
+
+	db, err := Open("binary.db", Config{Storage: storage})
+	require.Nil(t, err)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("doc", document("binary")))
+	require.Nil(t, tx.Set("small", "value"))
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(true)
+	require.Nil(t, tx.Delete("small"))
+	require.Nil(t, tx.Set("other", "value"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, db.Close())
+
+	// A torn record at the end of the log is ignored
+	segments, err := readManifest("binary.db")
+	require.Nil(t, err)
+	f, err := os.OpenFile(segments[len(segments)-1].path, os.O_APPEND|os.O_WRONLY, 0666)
+	require.Nil(t, err)
+	_, err = f.Write([]byte{20, binarySET, 3})
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	config.Persist = true
+	db, err = Open("binary.db", config)
+	require.Nil(t, err)
+
+	assert.Equal(t, 2, countKeys(t, db))
+	value, err := db.Begin(false).Get("doc")
+	require.Nil(t, err)
+	assert.Equal(t, document("binary"), value)
+	require.Nil(t, db.Close())
+
+	_, err = Open("binary.db", Config{Persist: true})
+	assert.Equal(t, ErrFormatMismatch, err)
+}
+
+func TestBinaryFormat(t *testing.T) {
+	items := []fileItem{
+		{item: item{key: "1", value: "first"}, command: commandSET},
+		{item: item{key: "1"}, command: commandDEL},
+		{item: item{key: "2", value: "compressed", codec: getCompressor("flate")}, command: commandSET},
+	}
+
+	os.Remove("test.db")
+	defer os.Remove("test.db")
+
+	fs, err := openFileStorage("test.db", fileOptions{format: binaryFormat{}})
+	require.Nil(t, err)
+	require.Nil(t, fs.write(items...))
+	require.Nil(t, fs.Close())
+
+	fs, err = openFileStorage("test.db", fileOptions{format: binaryFormat{}})
+	require.Nil(t, err)
+	got := make([]fileItem, 0)
+	require.Nil(t, fs.load(0, func(loaded []fileItem) error {
+		got = append(got, loaded...)
+		return nil
+	}))
+	require.Nil(t, fs.Close())
+	assert.Equal(t, items, got)
+
+	// Logs are opened in the format they are written in only
+	_, err = openFileStorage("test.db", fileOptions{})
+	assert.Equal(t, ErrFormatMismatch, err)
+
+	writeTestLog(t, "test.db", 10, fileOptions{})
+	_, err = openFileStorage("test.db", fileOptions{format: binaryFormat{}})
+	assert.Equal(t, ErrFormatMismatch, err)
+
+	_, err = binaryFormat{}.decode([]byte{2, 9, 0})
+	assert.Equal(t, ErrCorruptedLog, err)
+}
@@ -0,0 +1,304 @@
+package memdb
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unsafe"
+
+	"github.com/tidwall/btree"
+)
+
+// TextIndex is an inverted index over the words of values whose keys match pattern.
+// Postings and documents are kept in btrees so the index is cloned the same
+// copy-on-write way as Index.
+type TextIndex struct {
+	name     string
+	pattern  string
+	postings *btree.BTree
+	docs     *btree.BTree
+}
+
+type posting struct {
+	term      string
+	key       dbKey
+	positions []int
+}
+
+func (p *posting) Less(bitem btree.Item, ctx interface{}) bool {
+	p2 := bitem.(*posting)
+	if p.term != p2.term {
+		return p.term < p2.term
+	}
+
+	return p.key < p2.key
+}
+
+type textDoc struct {
+	key   dbKey
+	item  *item
+	terms []string
+}
+
+func (d *textDoc) Less(bitem btree.Item, ctx interface{}) bool {
+	return d.key < bitem.(*textDoc).key
+}
+
+func NewTextIndex(name, pattern string) *TextIndex {
+	return &TextIndex{
+		name:     name,
+		pattern:  pattern,
+		postings: btree.New(btreeDegrees, nil),
+		docs:     btree.New(btreeDegrees, nil),
+	}
+}
+
+func (idx *TextIndex) insert(item *item) {
+	idx.remove(item.key)
+
+	positions := make(map[string][]int)
+	terms := make([]string, 0)
+	for pos, term := range tokenize(item.plainOrEmpty()) {
+		if _, ok := positions[term]; !ok {
+			terms = append(terms, term)
+		}
+		positions[term] = append(positions[term], pos)
+	}
+
+	for _, term := range terms {
+		idx.postings.ReplaceOrInsert(&posting{term: term, key: item.key, positions: positions[term]})
+	}
+
+	idx.docs.ReplaceOrInsert(&textDoc{key: item.key, item: item, terms: terms})
+}
+
+func (idx *TextIndex) remove(key dbKey) {
+	old := idx.docs.Delete(&textDoc{key: key})
+	if old == nil {
+		return
+	}
+
+	for _, term := range old.(*textDoc).terms {
+		idx.postings.Delete(&posting{term: term, key: key})
+	}
+}
+
+func (idx *TextIndex) stats() IndexStats {
+	memory := idx.postings.Len()*(btreeEntrySize+int(unsafe.Sizeof(posting{}))) +
+		idx.docs.Len()*(btreeEntrySize+int(unsafe.Sizeof(textDoc{})))
+
+	return IndexStats{
+		Name:    idx.name,
+		Pattern: idx.pattern,
+		Text:    true,
+		Items:   idx.docs.Len(),
+		Memory:  memory,
+	}
+}
+
+func (idx *TextIndex) clone() *TextIndex {
+	return &TextIndex{
+		name:     idx.name,
+		pattern:  idx.pattern,
+		postings: idx.postings.Clone(),
+		docs:     idx.docs.Clone(),
+	}
+}
+
+func (idx *TextIndex) term(term string) map[dbKey][]int {
+	found := make(map[dbKey][]int)
+	idx.postings.AscendGreaterOrEqual(&posting{term: term}, func(bitem btree.Item) bool {
+		p := bitem.(*posting)
+		if p.term != term {
+			return false
+		}
+
+		found[p.key] = p.positions
+		return true
+	})
+
+	return found
+}
+
+func (idx *TextIndex) prefix(prefix string) map[dbKey][]int {
+	found := make(map[dbKey][]int)
+	idx.postings.AscendGreaterOrEqual(&posting{term: prefix}, func(bitem btree.Item) bool {
+		p := bitem.(*posting)
+		if !strings.HasPrefix(p.term, prefix) {
+			return false
+		}
+
+		found[p.key] = p.positions
+		return true
+	})
+
+	return found
+}
+
+func (idx *TextIndex) phrase(words []string) map[dbKey][]int {
+	if len(words) == 0 {
+		return map[dbKey][]int{}
+	}
+
+	found := idx.term(words[0])
+	for offset, word := range words[1:] {
+		next := idx.term(word)
+		for key, starts := range found {
+			positions, ok := next[key]
+			if !ok {
+				delete(found, key)
+				continue
+			}
+
+			matched := make([]int, 0)
+			for _, start := range starts {
+				if containsInt(positions, start+offset+1) {
+					matched = append(matched, start)
+				}
+			}
+
+			if len(matched) == 0 {
+				delete(found, key)
+				continue
+			}
+
+			found[key] = matched
+		}
+	}
+
+	return found
+}
+
+// search evaluates query and returns the matching documents ordered by key.
+func (idx *TextIndex) search(query string) []*item {
+	result := make(map[dbKey]struct{})
+	for _, clause := range parseTextQuery(query) {
+		var matched map[dbKey][]int
+		for i, term := range clause {
+			var found map[dbKey][]int
+			switch {
+			case term.phrase:
+				found = idx.phrase(term.words)
+			case term.prefix:
+				found = idx.prefix(term.words[0])
+			default:
+				found = idx.term(term.words[0])
+			}
+
+			if i == 0 {
+				matched = found
+				continue
+			}
+
+			for key := range matched {
+				if _, ok := found[key]; !ok {
+					delete(matched, key)
+				}
+			}
+		}
+
+		for key := range matched {
+			result[key] = struct{}{}
+		}
+	}
+
+	keys := make([]string, 0, len(result))
+	for key := range result {
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+
+	items := make([]*item, 0, len(keys))
+	for _, key := range keys {
+		doc := idx.docs.Get(&textDoc{key: dbKey(key)})
+		if doc != nil {
+			items = append(items, doc.(*textDoc).item)
+		}
+	}
+
+	return items
+}
+
+type textTerm struct {
+	words  []string
+	phrase bool
+	prefix bool
+}
+
+// parseTextQuery splits query into OR-separated clauses of AND-ed terms.
+// A term is a word, a word followed by * for prefix match, or a "quoted phrase".
+func parseTextQuery(query string) [][]textTerm {
+	clauses := make([][]textTerm, 0)
+	clause := make([]textTerm, 0)
+
+	flush := func() {
+		if len(clause) > 0 {
+			clauses = append(clauses, clause)
+		}
+		clause = make([]textTerm, 0)
+	}
+
+	for len(query) > 0 {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		if query == "" {
+			break
+		}
+
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			var phrase string
+			if end < 0 {
+				phrase, query = query[1:], ""
+			} else {
+				phrase, query = query[1:end+1], query[end+2:]
+			}
+
+			if words := tokenize(phrase); len(words) > 0 {
+				clause = append(clause, textTerm{words: words, phrase: true})
+			}
+			continue
+		}
+
+		end := strings.IndexFunc(query, unicode.IsSpace)
+		if end < 0 {
+			end = len(query)
+		}
+		word := query[:end]
+		query = query[end:]
+
+		if word == "OR" {
+			flush()
+			continue
+		}
+
+		if word == "AND" {
+			continue
+		}
+
+		prefix := strings.HasSuffix(word, "*")
+		words := tokenize(word)
+		for i, w := range words {
+			clause = append(clause, textTerm{words: []string{w}, prefix: prefix && i == len(words)-1})
+		}
+	}
+
+	flush()
+	return clauses
+}
+
+// tokenize splits s into lower-cased words of letters and digits.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,84 @@
+package memdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextIndex_Search(t *testing.T) {
+	idx := NewTextIndex("text", "doc.*")
+	idx.insert(&item{key: "doc.1", value: "The quick brown fox"})
+	idx.insert(&item{key: "doc.2", value: "A quick red fox jumps"})
+	idx.insert(&item{key: "doc.3", value: "Brown bears, quickly!"})
+
+	search := func(query string) []string {
+		got := make([]string, 0)
+		for _, item := range idx.search(query) {
+			got = append(got, string(item.key))
+		}
+		return got
+	}
+
+	assert.Equal(t, []string{"doc.1", "doc.2"}, search("fox"))
+	assert.Equal(t, []string{"doc.1"}, search("quick brown"))
+	assert.Equal(t, []string{"doc.1"}, search("quick AND brown"))
+	assert.Equal(t, []string{"doc.2", "doc.3"}, search("red OR bears"))
+	assert.Equal(t, []string{"doc.1", "doc.2", "doc.3"}, search("quick*"))
+	assert.Equal(t, []string{"doc.1"}, search(`"quick brown"`))
+	assert.Equal(t, []string{}, search(`"brown quick"`))
+	assert.Equal(t, []string{}, search(""))
+
+	idx.insert(&item{key: "doc.1", value: "slow turtle"})
+	assert.Equal(t, []string{"doc.2"}, search("fox"))
+
+	idx.remove("doc.2")
+	assert.Equal(t, []string{}, search("fox"))
+}
+
+func TestTransaction_Search(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("post.1", "hello world"))
+	require.Nil(t, tx.Set("post.2", "goodbye world"))
+	require.Nil(t, tx.Set("user.1", "hello"))
+	require.Nil(t, tx.AddTextIndex(NewTextIndex("posts", "post.*")))
+	require.Nil(t, tx.Commit())
+
+	search := func(tx *Transaction, query string) []string {
+		got := make([]string, 0)
+		require.Nil(t, tx.Search("posts", query, func(key, value string) bool {
+			got = append(got, key+"="+value)
+			return true
+		}))
+		return got
+	}
+
+	tx = db.Begin(true)
+	assert.Equal(t, []string{"post.1=hello world"}, search(tx, "hello"))
+
+	require.Nil(t, tx.Set("post.3", "hello again"))
+	_, err := tx.Update("post.1", "farewell world")
+	require.Nil(t, err)
+	require.Nil(t, tx.Delete("post.2"))
+	assert.Equal(t, []string{"post.3=hello again"}, search(tx, "hello"))
+	assert.Equal(t, []string{"post.1=farewell world"}, search(tx, "world"))
+
+	read := db.Begin(false)
+	assert.Equal(t, []string{"post.1=hello world", "post.2=goodbye world"}, search(read, "world"))
+
+	require.Nil(t, tx.Rollback())
+	assert.Equal(t, []string{"post.1=hello world", "post.2=goodbye world"}, search(db.Begin(false), "world"))
+
+	assert.Equal(t, ErrUnknownIndex, db.Begin(false).Search("unknown", "hello", func(key, value string) bool {
+		return true
+	}))
+}
+
+func TestIndexes_AddTextIndexExists(t *testing.T) {
+	indexer := newIndexer()
+	require.Nil(t, indexer.AddIndex(NewIndex("name", "*", func(a, b string) bool { return a < b })))
+	assert.Equal(t, ErrIndexExists, indexer.AddTextIndex(NewTextIndex("name", "*")))
+}
@@ -0,0 +1,576 @@
+package memdb
+
+import (
+	"sort"
+
+	"github.com/tidwall/btree"
+)
+
+// rankTree is a copy-on-write btree of btree.Item where every node knows the size
+// of its subtree. It has the same semantics as btree.BTree and adds order statistic
+// lookups, so ranks and positions are found without walking preceding items.
+type rankTree struct {
+	degree int
+	length int
+	root   *rankNode
+	ctx    interface{}
+	cow    *rankCow
+}
+
+// rankCow marks nodes owned by a tree, nodes of other owners are copied before modification
+type rankCow struct {
+	_ byte
+}
+
+type rankNode struct {
+	items    []btree.Item
+	children []*rankNode
+	size     int
+	cow      *rankCow
+}
+
+type removeType int
+
+const (
+	removeItem removeType = iota
+	removeMin
+	removeMax
+)
+
+func newRankTree(degree int, ctx interface{}) *rankTree {
+	return &rankTree{degree: degree, ctx: ctx, cow: new(rankCow)}
+}
+
+func (t *rankTree) maxItems() int {
+	return t.degree*2 - 1
+}
+
+func (t *rankTree) minItems() int {
+	return t.degree - 1
+}
+
+// Clone returns a copy of the tree in O(1), nodes are copied lazily on write by either tree
+func (t *rankTree) Clone() *rankTree {
+	out := *t
+	t.cow = new(rankCow)
+	out.cow = new(rankCow)
+	return &out
+}
+
+func (t *rankTree) Len() int {
+	return t.length
+}
+
+func (t *rankTree) ReplaceOrInsert(item btree.Item) btree.Item {
+	if item == nil {
+		panic("nil item being added to rankTree")
+	}
+
+	if t.root == nil {
+		t.root = &rankNode{cow: t.cow, items: []btree.Item{item}, size: 1}
+		t.length++
+		return nil
+	}
+
+	t.root = t.root.mutableFor(t.cow)
+	if len(t.root.items) >= t.maxItems() {
+		middle, second := t.root.split(t.maxItems() / 2)
+		first := t.root
+		t.root = &rankNode{
+			cow:      t.cow,
+			items:    []btree.Item{middle},
+			children: []*rankNode{first, second},
+			size:     first.size + second.size + 1,
+		}
+	}
+
+	out := t.root.insert(item, t.maxItems(), t.ctx)
+	if out == nil {
+		t.length++
+	}
+
+	return out
+}
+
+func (t *rankTree) Delete(item btree.Item) btree.Item {
+	return t.delete(item, removeItem)
+}
+
+func (t *rankTree) DeleteMin() btree.Item {
+	return t.delete(nil, removeMin)
+}
+
+func (t *rankTree) delete(item btree.Item, typ removeType) btree.Item {
+	if t.root == nil || len(t.root.items) == 0 {
+		return nil
+	}
+
+	t.root = t.root.mutableFor(t.cow)
+	out := t.root.remove(item, t.minItems(), typ, t.ctx)
+	if len(t.root.items) == 0 && len(t.root.children) > 0 {
+		t.root = t.root.children[0]
+	}
+
+	if out != nil {
+		t.length--
+	}
+
+	return out
+}
+
+func (t *rankTree) Get(key btree.Item) btree.Item {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key, t.ctx)
+		if found {
+			return n.items[i]
+		}
+
+		if len(n.children) == 0 {
+			break
+		}
+
+		n = n.children[i]
+	}
+
+	return nil
+}
+
+func (t *rankTree) Has(key btree.Item) bool {
+	return t.Get(key) != nil
+}
+
+func (t *rankTree) Min() btree.Item {
+	return t.At(0)
+}
+
+func (t *rankTree) Max() btree.Item {
+	return t.At(t.length - 1)
+}
+
+// At returns the item at position i in ascending order or nil if i is out of range
+func (t *rankTree) At(i int) btree.Item {
+	if t.root == nil || i < 0 || i >= t.length {
+		return nil
+	}
+
+	return t.root.at(i)
+}
+
+// Rank returns the number of items less than key
+func (t *rankTree) Rank(key btree.Item) int {
+	if t.root == nil {
+		return 0
+	}
+
+	return t.root.rank(key, t.ctx)
+}
+
+func (t *rankTree) Ascend(iterator btree.ItemIterator) {
+	t.AscendRange(nil, nil, iterator)
+}
+
+func (t *rankTree) AscendGreaterOrEqual(pivot btree.Item, iterator btree.ItemIterator) {
+	t.AscendRange(pivot, nil, iterator)
+}
+
+func (t *rankTree) AscendLessThan(pivot btree.Item, iterator btree.ItemIterator) {
+	t.AscendRange(nil, pivot, iterator)
+}
+
+// AscendRange calls iterator for items in [greaterOrEqual, lessThan), nil bounds are open
+func (t *rankTree) AscendRange(greaterOrEqual, lessThan btree.Item, iterator btree.ItemIterator) {
+	if t.root == nil {
+		return
+	}
+
+	t.root.ascend(greaterOrEqual, lessThan, iterator, t.ctx)
+}
+
+// AscendAt calls iterator for items starting from position i
+func (t *rankTree) AscendAt(i int, iterator btree.ItemIterator) {
+	if start := t.At(i); start != nil {
+		t.AscendGreaterOrEqual(start, iterator)
+	}
+}
+
+func (t *rankTree) Descend(iterator btree.ItemIterator) {
+	t.DescendRange(nil, nil, iterator)
+}
+
+func (t *rankTree) DescendLessOrEqual(pivot btree.Item, iterator btree.ItemIterator) {
+	t.DescendRange(pivot, nil, iterator)
+}
+
+func (t *rankTree) DescendGreaterThan(pivot btree.Item, iterator btree.ItemIterator) {
+	t.DescendRange(nil, pivot, iterator)
+}
+
+// DescendRange calls iterator for items in [greaterThan, lessOrEqual] in descending order
+// excluding greaterThan itself, nil bounds are open
+func (t *rankTree) DescendRange(lessOrEqual, greaterThan btree.Item, iterator btree.ItemIterator) {
+	if t.root == nil {
+		return
+	}
+
+	t.root.descend(lessOrEqual, greaterThan, iterator, t.ctx)
+}
+
+func (n *rankNode) mutableFor(cow *rankCow) *rankNode {
+	if n.cow == cow {
+		return n
+	}
+
+	out := &rankNode{cow: cow, size: n.size}
+	out.items = append(make([]btree.Item, 0, len(n.items)), n.items...)
+	if len(n.children) > 0 {
+		out.children = append(make([]*rankNode, 0, len(n.children)), n.children...)
+	}
+
+	return out
+}
+
+func (n *rankNode) mutableChild(i int) *rankNode {
+	c := n.children[i].mutableFor(n.cow)
+	n.children[i] = c
+	return c
+}
+
+func (n *rankNode) find(key btree.Item, ctx interface{}) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return key.Less(n.items[i], ctx)
+	})
+
+	if i > 0 && !n.items[i-1].Less(key, ctx) {
+		return i - 1, true
+	}
+
+	return i, false
+}
+
+// split moves items after i into a new node and returns the item at i
+func (n *rankNode) split(i int) (btree.Item, *rankNode) {
+	item := n.items[i]
+	next := &rankNode{cow: n.cow}
+	next.items = append(next.items, n.items[i+1:]...)
+	n.items = truncateItems(n.items, i)
+
+	if len(n.children) > 0 {
+		next.children = append(next.children, n.children[i+1:]...)
+		n.children = truncateNodes(n.children, i+1)
+	}
+
+	next.size = next.count()
+	n.size = n.count()
+
+	return item, next
+}
+
+func (n *rankNode) count() int {
+	size := len(n.items)
+	for _, child := range n.children {
+		size += child.size
+	}
+
+	return size
+}
+
+func (n *rankNode) maybeSplitChild(i, maxItems int) bool {
+	if len(n.children[i].items) < maxItems {
+		return false
+	}
+
+	first := n.mutableChild(i)
+	item, second := first.split(maxItems / 2)
+	n.items = insertItemAt(n.items, i, item)
+	n.children = insertNodeAt(n.children, i+1, second)
+
+	return true
+}
+
+func (n *rankNode) insert(item btree.Item, maxItems int, ctx interface{}) btree.Item {
+	i, found := n.find(item, ctx)
+	if found {
+		out := n.items[i]
+		n.items[i] = item
+		return out
+	}
+
+	if len(n.children) == 0 {
+		n.items = insertItemAt(n.items, i, item)
+		n.size++
+		return nil
+	}
+
+	if n.maybeSplitChild(i, maxItems) {
+		inTree := n.items[i]
+		switch {
+		case item.Less(inTree, ctx):
+		case inTree.Less(item, ctx):
+			i++
+		default:
+			n.items[i] = item
+			return inTree
+		}
+	}
+
+	out := n.mutableChild(i).insert(item, maxItems, ctx)
+	if out == nil {
+		n.size++
+	}
+
+	return out
+}
+
+func (n *rankNode) remove(item btree.Item, minItems int, typ removeType, ctx interface{}) btree.Item {
+	var i int
+	var found bool
+
+	switch typ {
+	case removeMax:
+		if len(n.children) == 0 {
+			out := n.items[len(n.items)-1]
+			n.items = removeItemAt(n.items, len(n.items)-1)
+			n.size--
+			return out
+		}
+		i = len(n.items)
+	case removeMin:
+		if len(n.children) == 0 {
+			out := n.items[0]
+			n.items = removeItemAt(n.items, 0)
+			n.size--
+			return out
+		}
+	case removeItem:
+		i, found = n.find(item, ctx)
+		if len(n.children) == 0 {
+			if !found {
+				return nil
+			}
+
+			out := n.items[i]
+			n.items = removeItemAt(n.items, i)
+			n.size--
+			return out
+		}
+	}
+
+	if len(n.children[i].items) <= minItems {
+		return n.growChildAndRemove(i, item, minItems, typ, ctx)
+	}
+
+	child := n.mutableChild(i)
+	if found {
+		// Replace the removed item with its predecessor
+		out := n.items[i]
+		n.items[i] = child.remove(nil, minItems, removeMax, ctx)
+		n.size--
+		return out
+	}
+
+	out := child.remove(item, minItems, typ, ctx)
+	if out != nil {
+		n.size--
+	}
+
+	return out
+}
+
+// growChildAndRemove makes child i hold more than minItems by stealing from
+// a sibling or merging with it, then retries the removal
+func (n *rankNode) growChildAndRemove(i int, item btree.Item, minItems int, typ removeType, ctx interface{}) btree.Item {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > minItems:
+		child := n.mutableChild(i)
+		stealFrom := n.mutableChild(i - 1)
+
+		stolen := stealFrom.items[len(stealFrom.items)-1]
+		stealFrom.items = removeItemAt(stealFrom.items, len(stealFrom.items)-1)
+		child.items = insertItemAt(child.items, 0, n.items[i-1])
+		n.items[i-1] = stolen
+		moved := 1
+
+		if len(stealFrom.children) > 0 {
+			c := stealFrom.children[len(stealFrom.children)-1]
+			stealFrom.children = truncateNodes(stealFrom.children, len(stealFrom.children)-1)
+			child.children = insertNodeAt(child.children, 0, c)
+			moved += c.size
+		}
+
+		stealFrom.size -= moved
+		child.size += moved
+	case i < len(n.items) && len(n.children[i+1].items) > minItems:
+		child := n.mutableChild(i)
+		stealFrom := n.mutableChild(i + 1)
+
+		stolen := stealFrom.items[0]
+		stealFrom.items = removeItemAt(stealFrom.items, 0)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = stolen
+		moved := 1
+
+		if len(stealFrom.children) > 0 {
+			c := stealFrom.children[0]
+			stealFrom.children = removeNodeAt(stealFrom.children, 0)
+			child.children = append(child.children, c)
+			moved += c.size
+		}
+
+		stealFrom.size -= moved
+		child.size += moved
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+
+		child := n.mutableChild(i)
+		merged := n.items[i]
+		mergeChild := n.children[i+1]
+		n.items = removeItemAt(n.items, i)
+		n.children = removeNodeAt(n.children, i+1)
+
+		child.items = append(child.items, merged)
+		child.items = append(child.items, mergeChild.items...)
+		child.children = append(child.children, mergeChild.children...)
+		child.size += mergeChild.size + 1
+	}
+
+	return n.remove(item, minItems, typ, ctx)
+}
+
+func (n *rankNode) at(i int) btree.Item {
+	if len(n.children) == 0 {
+		return n.items[i]
+	}
+
+	for j, child := range n.children {
+		if i < child.size {
+			return child.at(i)
+		}
+
+		i -= child.size
+		if j < len(n.items) {
+			if i == 0 {
+				return n.items[j]
+			}
+			i--
+		}
+	}
+
+	return nil
+}
+
+func (n *rankNode) rank(key btree.Item, ctx interface{}) int {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return !n.items[i].Less(key, ctx)
+	})
+
+	rank := i
+	if len(n.children) > 0 {
+		for _, child := range n.children[:i] {
+			rank += child.size
+		}
+		rank += n.children[i].rank(key, ctx)
+	}
+
+	return rank
+}
+
+func (n *rankNode) ascend(from, to btree.Item, iterator btree.ItemIterator, ctx interface{}) bool {
+	i := 0
+	if from != nil {
+		i = sort.Search(len(n.items), func(i int) bool {
+			return !n.items[i].Less(from, ctx)
+		})
+	}
+
+	for ; i < len(n.items); i++ {
+		if len(n.children) > 0 && !n.children[i].ascend(from, to, iterator, ctx) {
+			return false
+		}
+
+		if to != nil && !n.items[i].Less(to, ctx) {
+			return false
+		}
+
+		if !iterator(n.items[i]) {
+			return false
+		}
+	}
+
+	if len(n.children) > 0 {
+		return n.children[len(n.children)-1].ascend(from, to, iterator, ctx)
+	}
+
+	return true
+}
+
+func (n *rankNode) descend(from, to btree.Item, iterator btree.ItemIterator, ctx interface{}) bool {
+	i := len(n.items)
+	if from != nil {
+		i = sort.Search(len(n.items), func(i int) bool {
+			return from.Less(n.items[i], ctx)
+		})
+	}
+
+	if len(n.children) > 0 && !n.children[i].descend(from, to, iterator, ctx) {
+		return false
+	}
+
+	for i--; i >= 0; i-- {
+		if to != nil && !to.Less(n.items[i], ctx) {
+			return false
+		}
+
+		if !iterator(n.items[i]) {
+			return false
+		}
+
+		if len(n.children) > 0 && !n.children[i].descend(from, to, iterator, ctx) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func insertItemAt(items []btree.Item, i int, item btree.Item) []btree.Item {
+	items = append(items, nil)
+	copy(items[i+1:], items[i:])
+	items[i] = item
+	return items
+}
+
+func removeItemAt(items []btree.Item, i int) []btree.Item {
+	copy(items[i:], items[i+1:])
+	items[len(items)-1] = nil
+	return items[:len(items)-1]
+}
+
+func truncateItems(items []btree.Item, i int) []btree.Item {
+	for j := i; j < len(items); j++ {
+		items[j] = nil
+	}
+	return items[:i]
+}
+
+func insertNodeAt(nodes []*rankNode, i int, node *rankNode) []*rankNode {
+	nodes = append(nodes, nil)
+	copy(nodes[i+1:], nodes[i:])
+	nodes[i] = node
+	return nodes
+}
+
+func removeNodeAt(nodes []*rankNode, i int) []*rankNode {
+	copy(nodes[i:], nodes[i+1:])
+	nodes[len(nodes)-1] = nil
+	return nodes[:len(nodes)-1]
+}
+
+func truncateNodes(nodes []*rankNode, i int) []*rankNode {
+	for j := i; j < len(nodes); j++ {
+		nodes[j] = nil
+	}
+	return nodes[:i]
+}
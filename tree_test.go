@@ -0,0 +1,107 @@
+package memdb
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/btree"
+)
+
+type intItem int
+
+func (i intItem) Less(than btree.Item, ctx interface{}) bool {
+	return i < than.(intItem)
+}
+
+func treeItems(t *rankTree) []int {
+	got := make([]int, 0, t.Len())
+	t.Ascend(func(i btree.Item) bool {
+		got = append(got, int(i.(intItem)))
+		return true
+	})
+	return got
+}
+
+func TestRankTree_Random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree := newRankTree(3, nil)
+	expected := make(map[int]struct{})
+
+	var clone *rankTree
+	var cloned []int
+
+	for n := 0; n < 20000; n++ {
+		v := r.Intn(2000)
+		if r.Intn(3) == 0 {
+			_, ok := expected[v]
+			removed := tree.Delete(intItem(v))
+			assert.Equal(t, ok, removed != nil)
+			delete(expected, v)
+		} else {
+			tree.ReplaceOrInsert(intItem(v))
+			expected[v] = struct{}{}
+		}
+
+		if n%5000 == 0 {
+			clone = tree.Clone()
+			cloned = treeItems(clone)
+		}
+	}
+
+	want := make([]int, 0, len(expected))
+	for v := range expected {
+		want = append(want, v)
+	}
+	sort.Ints(want)
+
+	require.Equal(t, want, treeItems(tree))
+	require.Equal(t, len(want), tree.Len())
+	require.Equal(t, cloned, treeItems(clone))
+
+	for i, v := range want {
+		require.Equal(t, intItem(v), tree.At(i))
+		require.Equal(t, i, tree.Rank(intItem(v)))
+	}
+
+	assert.Nil(t, tree.At(len(want)))
+	assert.Equal(t, intItem(want[0]), tree.Min())
+	assert.Equal(t, intItem(want[len(want)-1]), tree.Max())
+	assert.Equal(t, len(want), tree.Rank(intItem(1<<30)))
+}
+
+func TestRankTree_Ranges(t *testing.T) {
+	tree := newRankTree(2, nil)
+	for i := 0; i < 100; i += 2 {
+		tree.ReplaceOrInsert(intItem(i))
+	}
+
+	collect := func(fn func(btree.ItemIterator)) []int {
+		got := make([]int, 0)
+		fn(func(i btree.Item) bool {
+			got = append(got, int(i.(intItem)))
+			return len(got) < 4
+		})
+		return got
+	}
+
+	assert.Equal(t, []int{10, 12, 14, 16}, collect(func(it btree.ItemIterator) {
+		tree.AscendGreaterOrEqual(intItem(9), it)
+	}))
+	assert.Equal(t, []int{10, 12}, collect(func(it btree.ItemIterator) {
+		tree.AscendRange(intItem(10), intItem(14), it)
+	}))
+	assert.Equal(t, []int{20, 22, 24, 26}, collect(func(it btree.ItemIterator) {
+		tree.AscendAt(10, it)
+	}))
+	assert.Equal(t, []int{10, 8, 6, 4}, collect(func(it btree.ItemIterator) {
+		tree.DescendLessOrEqual(intItem(11), it)
+	}))
+	assert.Equal(t, []int{10, 8}, collect(func(it btree.ItemIterator) {
+		tree.DescendRange(intItem(10), intItem(6), it)
+	}))
+	assert.Equal(t, []int{98, 96, 94, 92}, collect(tree.Descend))
+	assert.Equal(t, 5, tree.Rank(intItem(9)))
+}
@@ -42,12 +42,58 @@ func (tx *Transaction) Set(key, value string) error {
 	}
 
 	new := &item{key: k, value: value}
+	tx.db.compression.pack(new)
 	tx.createItem(new)
 	tx.newIndexes.Insert(new)
 
 	return nil
 }
 
+// SetMany creates all items of kv at once. Nothing is created if one of the keys already exists.
+func (tx *Transaction) SetMany(kv map[string]string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	created := make([]*dbItem, 0, len(kv))
+	// Keys deleted by the transaction keep their items, see createItem
+	deleted := make([]*item, 0)
+	for key, value := range kv {
+		k := dbKey(key)
+		if _, err := tx.getKey(k); err != ErrNotFound {
+			return ErrAlreadyExists
+		}
+
+		new := &item{key: k, value: value}
+		tx.db.compression.pack(new)
+		if tx.db.items.get(k) != nil {
+			deleted = append(deleted, new)
+			continue
+		}
+		created = append(created, &dbItem{key: k, pending: new})
+	}
+
+	tx.db.items.setMany(created)
+	for _, dbItem := range created {
+		tx.pendingItems[dbItem.key] = struct{}{}
+		tx.newIndexes.Insert(dbItem.pending)
+	}
+
+	for _, new := range deleted {
+		tx.updateItem(new.key, new, false)
+		tx.newIndexes.Insert(new)
+	}
+
+	return nil
+}
+
 func (tx *Transaction) Get(key string) (string, error) {
 	if tx.db == nil {
 		return "", ErrTxClosed
@@ -58,7 +104,7 @@ func (tx *Transaction) Get(key string) (string, error) {
 		return "", err
 	}
 
-	return item.value, nil
+	return item.plain()
 }
 
 func (tx *Transaction) Delete(key string) error {
@@ -85,6 +131,37 @@ func (tx *Transaction) Delete(key string) error {
 	return nil
 }
 
+// DeleteMany deletes all keys at once. Nothing is deleted if one of the keys doesn't exist.
+func (tx *Transaction) DeleteMany(keys ...string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	items := make([]item, 0, len(keys))
+	for _, key := range keys {
+		item, err := tx.getKey(dbKey(key))
+		if err != nil {
+			return err
+		}
+
+		items = append(items, item)
+	}
+
+	for i := range items {
+		tx.updateItem(items[i].key, nil, true)
+		tx.newIndexes.Remove(&items[i])
+	}
+
+	return nil
+}
+
 func (tx *Transaction) Update(key, value string) (string, error) {
 	k := dbKey(key)
 	tx.mu.Lock()
@@ -103,13 +180,22 @@ func (tx *Transaction) Update(key, value string) (string, error) {
 		return "", err
 	}
 
+	oldValue, err := old.plain()
+	if err != nil {
+		return "", err
+	}
+
 	update := &item{key: k, value: value}
+	tx.db.compression.pack(update)
 	tx.updateItem(k, update, false)
+	tx.newIndexes.Remove(&old)
 	tx.newIndexes.Insert(update)
 
-	return old.value, nil
+	return oldValue, nil
 }
 
+// AddIndex adds indexes filled with the visible items. An index with the definition
+// of an existing one is left as it is, so indexes restored by Open can be added again.
 func (tx *Transaction) AddIndex(indexes ...*Index) error {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
@@ -132,6 +218,11 @@ func (tx *Transaction) AddIndex(indexes ...*Index) error {
 
 	inserted := make([]string, 0)
 	for _, index := range indexes {
+		existing := tx.newIndexes.GetIndex(index.name)
+		if existing != nil && existing.pattern == index.pattern && existing.comparator == index.comparator {
+			continue
+		}
+
 		err := tx.newIndexes.AddIndex(index)
 		if err != nil {
 			rollbackInserted(inserted)
@@ -141,36 +232,157 @@ func (tx *Transaction) AddIndex(indexes ...*Index) error {
 		inserted = append(inserted, index.name)
 	}
 
+	if err := tx.fillIndexes(inserted); err != nil {
+		rollbackInserted(inserted)
+		return err
+	}
+
+	return nil
+}
+
+// AddTextIndex adds text indexes like AddIndex
+func (tx *Transaction) AddTextIndex(indexes ...*TextIndex) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	rollbackInserted := func(inserted []string) {
+		for _, idx := range inserted {
+			if err := tx.newIndexes.RemoveIndex(idx); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	inserted := make([]string, 0)
+	for _, index := range indexes {
+		existing := tx.newIndexes.GetTextIndex(index.name)
+		if existing != nil && existing.pattern == index.pattern {
+			continue
+		}
+
+		err := tx.newIndexes.AddTextIndex(index)
+		if err != nil {
+			rollbackInserted(inserted)
+			return err
+		}
+
+		inserted = append(inserted, index.name)
+	}
+
+	if err := tx.fillIndexes(inserted); err != nil {
+		rollbackInserted(inserted)
+		return err
+	}
+
+	return nil
+}
+
+// fillIndexes inserts every visible item into the given indexes
+func (tx *Transaction) fillIndexes(indexes []string) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+
 	for _, key := range tx.db.items.keys() {
 		revision, err := tx.getKey(key)
+		if err == ErrNotFound {
+			continue
+		}
 		if err != nil {
-			rollbackInserted(inserted)
 			return err
 		}
 
-		tx.newIndexes.Insert(&revision, inserted...)
+		tx.newIndexes.Insert(&revision, indexes...)
 	}
 
 	return nil
 }
 
 func (tx *Transaction) RemoveIndex(name string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+
 	return tx.newIndexes.RemoveIndex(name)
 }
 
 func (tx *Transaction) Len(name string) (int, error) {
-	i := tx.newIndexes.GetIndex(name)
-	if i == nil {
-		return 0, ErrUnknownIndex
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	i, err := tx.index(name)
+	if err != nil {
+		return 0, err
 	}
 
 	return i.tree.Len(), nil
 }
 
+func (tx *Transaction) IndexStats(name string) (IndexStats, error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	if tx.db == nil {
+		return IndexStats{}, ErrTxClosed
+	}
+
+	if name == "" {
+		return IndexStats{}, ErrEmptyIndex
+	}
+
+	indexes := tx.db.committedIndexes()
+	if tx.writable {
+		indexes = tx.newIndexes
+	}
+
+	if i := indexes.GetIndex(name); i != nil {
+		return i.stats(), nil
+	}
+
+	if i := indexes.GetTextIndex(name); i != nil {
+		return i.stats(), nil
+	}
+
+	return IndexStats{}, ErrUnknownIndex
+}
+
 func (tx *Transaction) Ascend(index string, iterator func(key, value string) bool) error {
 	tx.mu.RLock()
 	defer tx.mu.RUnlock()
 
+	i, err := tx.index(index)
+	if err != nil {
+		return err
+	}
+
+	var curitem *item
+	i.tree.Ascend(func(bitem btree.Item) bool {
+		curitem = bitem.(*item)
+		return curitem.visit(iterator, &err)
+	})
+
+	return err
+}
+
+func (tx *Transaction) Search(index, query string, iterator func(key, value string) bool) error {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
 	if tx.db == nil {
 		return ErrTxClosed
 	}
@@ -179,23 +391,24 @@ func (tx *Transaction) Ascend(index string, iterator func(key, value string) boo
 		return ErrEmptyIndex
 	}
 
-	indexes := tx.db.indexes
+	indexes := tx.db.committedIndexes()
 	if tx.writable {
 		indexes = tx.newIndexes
 	}
 
-	i := indexes.GetIndex(index)
+	i := indexes.GetTextIndex(index)
 	if i == nil {
 		return ErrUnknownIndex
 	}
 
-	var curitem *item
-	i.tree.Ascend(func(bitem btree.Item) bool {
-		curitem = bitem.(*item)
-		return iterator(string(curitem.key), curitem.value)
-	})
+	var err error
+	for _, item := range i.search(query) {
+		if !item.visit(iterator, &err) {
+			break
+		}
+	}
 
-	return nil
+	return err
 }
 
 func (tx *Transaction) Commit() error {
@@ -210,15 +423,17 @@ func (tx *Transaction) Commit() error {
 	tx.db = nil
 
 	if tx.writable {
-		save := make([]fileItem, 0)
+		save := make([]Record, 0)
 
 		for key := range tx.pendingItems {
+			db.items.replacing(key)
+
 			dbItem := db.items.get(key)
 			dbItem.Lock()
 
 			if dbItem.pendingDeleted {
 				if dbItem.current != nil {
-					save = append(save, fileItem{item: item{key: key}, command: commandDEL})
+					save = append(save, dbItem.current.record(true))
 				}
 				dbItem.Unlock()
 				db.items.remove(key)
@@ -227,27 +442,30 @@ func (tx *Transaction) Commit() error {
 
 			// Delete old record
 			if dbItem.current != nil {
-				save = append(save, fileItem{item: item{key: key}, command: commandDEL})
+				save = append(save, dbItem.current.record(true))
 			}
 
-			save = append(save, fileItem{item: item{key: key, value: dbItem.pending.value}, command: commandSET})
+			save = append(save, dbItem.pending.record(false))
 			dbItem.current = dbItem.pending
 			dbItem.pending = nil
 			dbItem.Unlock()
 		}
 
 		tx.pendingItems = nil
-		db.indexes = tx.newIndexes
+		db.setIndexes(tx.newIndexes.merge())
 
-		// Write to disk
-		if db.persist {
-			err := db.persistentStorage.write(save...)
-			if err != nil {
-				return err
-			}
+		// Write to disk, the write lock is released before waiting
+		// so the next commits join the same group
+		var wait func() error
+		if db.storage != nil && len(save) > 0 {
+			wait = db.storage.Append(save)
 		}
 
 		db.writeTx.Unlock()
+
+		if wait != nil {
+			return wait()
+		}
 	}
 
 	return nil
@@ -262,8 +480,23 @@ func (tx *Transaction) Rollback() error {
 	}
 
 	db := tx.db
+	tx.db = nil
 
 	if tx.writable {
+		// Drop pending changes, items created by the transaction are removed completely
+		for key := range tx.pendingItems {
+			dbItem := db.items.get(key)
+			dbItem.Lock()
+			dbItem.pending = nil
+			dbItem.pendingDeleted = false
+			created := dbItem.current == nil
+			dbItem.Unlock()
+
+			if created {
+				db.items.remove(key)
+			}
+		}
+
 		tx.newIndexes = nil
 		tx.pendingItems = nil
 		db.writeTx.Unlock()
@@ -272,6 +505,33 @@ func (tx *Transaction) Rollback() error {
 	return nil
 }
 
+// index returns a queryable index visible to the transaction, the caller must hold tx.mu
+func (tx *Transaction) index(name string) (*Index, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+
+	if name == "" {
+		return nil, ErrEmptyIndex
+	}
+
+	indexes := tx.db.committedIndexes()
+	if tx.writable {
+		indexes = tx.newIndexes
+	}
+
+	i := indexes.GetIndex(name)
+	if i == nil {
+		return nil, ErrUnknownIndex
+	}
+
+	if i.building != nil {
+		return nil, ErrIndexBuilding
+	}
+
+	return i, nil
+}
+
 func (tx *Transaction) getKey(key dbKey) (item, error) {
 	dbItem := tx.db.items.get(key)
 
@@ -295,7 +555,14 @@ func (tx *Transaction) getKey(key dbKey) (item, error) {
 	return *dbItem.current, nil
 }
 
+// createItem adds the pending item of a new key. A key deleted by the transaction keeps
+// its item with the committed value, so Rollback restores the key instead of removing it.
 func (tx *Transaction) createItem(item *item) {
+	if tx.db.items.get(item.key) != nil {
+		tx.updateItem(item.key, item, false)
+		return
+	}
+
 	dbItem := &dbItem{key: item.key, pending: item}
 
 	dbItem.Lock()
@@ -2,6 +2,8 @@ package memdb
 
 import (
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -77,8 +79,9 @@ func TestTransaction_SetPersistent(t *testing.T) {
 	assert.Nil(t, tx1.Commit())
 	assert.Nil(t, db.Close())
 
-	fs, err := openFileStorage("test.db")
+	fs, err := openFileStorage("test.db", fileOptions{})
 	assert.Nil(t, err)
+	defer fs.Close()
 
 	got := make([]item, 0)
 	for item := range fs.read() {
@@ -176,6 +179,36 @@ func TestTransaction_Update(t *testing.T) {
 	assert.Equal(t, "second", r5)
 }
 
+func TestTransaction_UpdateIndexed(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("values", "*", func(a, b string) bool {
+		return a < b
+	})))
+	require.Nil(t, tx.Set("1", "a"))
+	require.Nil(t, tx.Set("2", "b"))
+	require.Nil(t, tx.Commit())
+
+	// The old value leaves the index, so the key is listed once at its new value
+	tx = db.Begin(true)
+	_, err := tx.Update("1", "c")
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	got := make([]string, 0)
+	require.Nil(t, tx.Ascend("values", func(key, value string) bool {
+		got = append(got, key+"="+value)
+		return true
+	}))
+	assert.Equal(t, []string{"2=b", "1=c"}, got)
+
+	length, err := tx.Len("values")
+	require.Nil(t, err)
+	assert.Equal(t, 2, length)
+}
+
 func TestTransaction_AddIndex(t *testing.T) {
 	db, _ := OpenDB("", false)
 
@@ -287,3 +320,149 @@ func TestTransaction_IndexIsolation(t *testing.T) {
 
 	assert.Equal(t, []string{"4", "2", "3", "5", "1", "6"}, got2)
 }
+
+func TestTransaction_IndexStats(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "abc"))
+	require.Nil(t, tx.AddIndex(NewIndex("test-len", "*", func(a, b string) bool {
+		return len(a) < len(b)
+	})))
+
+	stats, err := tx.IndexStats("test-len")
+	require.Nil(t, err)
+	assert.Equal(t, 1, stats.Items)
+	assert.Empty(t, db.Indexes())
+
+	_, err = tx.IndexStats("unknown")
+	assert.Equal(t, ErrUnknownIndex, err)
+	require.Nil(t, tx.Commit())
+
+	indexes := db.Indexes()
+	require.Len(t, indexes, 1)
+	assert.Equal(t, "test-len", indexes[0].Name)
+	assert.Equal(t, 1, indexes[0].Items)
+}
+
+func TestTransaction_RollbackPending(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "first"))
+	require.Nil(t, tx.Set("2", "second"))
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(true)
+	_, err := tx.Update("1", "updated")
+	require.Nil(t, err)
+	require.Nil(t, tx.Delete("2"))
+	require.Nil(t, tx.Set("3", "third"))
+	require.Nil(t, tx.Rollback())
+	assert.Equal(t, ErrTxClosed, tx.Rollback())
+
+	tx = db.Begin(true)
+	value, err := tx.Get("1")
+	require.Nil(t, err)
+	assert.Equal(t, "first", value)
+
+	value, err = tx.Get("2")
+	require.Nil(t, err)
+	assert.Equal(t, "second", value)
+
+	_, err = tx.Get("3")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, db.items.get("3"))
+}
+
+func TestTransaction_RollbackDeleteSet(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.Set("1", "first"))
+	require.Nil(t, tx.Set("2", "second"))
+	require.Nil(t, tx.Commit())
+
+	// Creating a key deleted in the same transaction doesn't drop it on rollback
+	tx = db.Begin(true)
+	require.Nil(t, tx.DeleteMany("1", "2"))
+	require.Nil(t, tx.Set("1", "new"))
+	require.Nil(t, tx.SetMany(map[string]string{"2": "new"}))
+	value, err := tx.Get("1")
+	require.Nil(t, err)
+	assert.Equal(t, "new", value)
+	require.Nil(t, tx.Rollback())
+
+	tx = db.Begin(false)
+	for key, expected := range map[string]string{"1": "first", "2": "second"} {
+		value, err := tx.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, expected, value)
+	}
+	require.Nil(t, tx.Commit())
+
+	// Committed, the new values replace the old ones
+	tx = db.Begin(true)
+	require.Nil(t, tx.Delete("1"))
+	require.Nil(t, tx.Set("1", "new"))
+	require.Nil(t, tx.Commit())
+
+	value, err = db.Begin(false).Get("1")
+	require.Nil(t, err)
+	assert.Equal(t, "new", value)
+}
+
+func TestTransaction_SetManyDeleteMany(t *testing.T) {
+	db, _ := OpenDB("", false)
+
+	tx := db.Begin(true)
+	require.Nil(t, tx.AddIndex(NewIndex("all", "*", func(a, b string) bool {
+		return a < b
+	})))
+	require.Nil(t, tx.SetMany(map[string]string{"1": "a", "2": "b", "3": "c"}))
+	assert.Equal(t, ErrAlreadyExists, tx.SetMany(map[string]string{"4": "d", "2": "b"}))
+
+	_, err := tx.Get("4")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Equal(t, ErrNotFound, tx.DeleteMany("1", "5"))
+	require.Nil(t, tx.DeleteMany("1", "3"))
+	require.Nil(t, tx.Commit())
+
+	tx = db.Begin(false)
+	got := make([]string, 0)
+	require.Nil(t, tx.Ascend("all", func(key, value string) bool {
+		got = append(got, key)
+		return true
+	}))
+	assert.Equal(t, []string{"2"}, got)
+}
+
+func TestTransaction_ConcurrentCommitPersistent(t *testing.T) {
+	os.RemoveAll("test.db")
+	db, err := OpenDB("test.db", true)
+	require.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx := db.Begin(true)
+			assert.Nil(t, tx.Set(strconv.Itoa(i), "value"))
+			assert.Nil(t, tx.Commit())
+		}(i)
+	}
+	wg.Wait()
+	require.Nil(t, db.Close())
+
+	db, err = OpenDB("test.db", true)
+	require.Nil(t, err)
+
+	tx := db.Begin(false)
+	for i := 0; i < 50; i++ {
+		_, err := tx.Get(strconv.Itoa(i))
+		assert.Nil(t, err)
+	}
+	require.Nil(t, db.Close())
+}